@@ -2,20 +2,30 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"embed"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
+	"io"
 	"io/fs"
 	"log"
 	"net/http"
+	"net/mail"
 	"os"
 	"os/signal"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
+	"github.com/ZenithSolitude/Hopefully/internal/audit"
 	"github.com/ZenithSolitude/Hopefully/internal/auth"
 	"github.com/ZenithSolitude/Hopefully/internal/db"
 	"github.com/ZenithSolitude/Hopefully/internal/modules"
@@ -28,23 +38,77 @@ var embedded embed.FS
 const version = "1.0.0"
 
 type Config struct {
-	Port    string
-	DataDir string
-	Secret  string
+	Port        string
+	DataDir     string
+	Secret      string
+	ModulePorts string
+	AccessTTL   time.Duration
+	SessionTTL  time.Duration
+	RememberTTL time.Duration
+	Password    auth.PasswordPolicy
+	LDAP        auth.LDAPConfig
+	LDAPGroups  string // соответствие групп ролям, см. auth.ParseGroupRoles
+	OIDC        auth.OIDCConfig
+	OIDCRoles   string // соответствие значений claim ролям, в том же формате
+	OIDCScopes  string
+	Proxy       auth.ProxyConfig
+	ProxyCIDRs  string // доверенные прокси через запятую
+	ProxyGroups string // соответствие групп прокси ролям
 }
 
 var cfg Config
-var tmpl *template.Template
+
+// tmpl — по набору шаблонов на страницу: все страницы переопределяют блоки
+// "title"/"content" из base.html, и в общем наборе победила бы последняя.
+var tmpl map[string]*template.Template
 
 func initTemplates() {
 	fns := template.FuncMap{
 		"hasPrefix": strings.HasPrefix,
-		"navItems":  modules.Default.NavItems,
-		"not":       func(v bool) bool { return !v },
+		"navItems":  navItems,
+		"running":   modules.IsRunning,
 	}
-	var err error
-	tmpl, err = template.New("").Funcs(fns).ParseFS(embedded, "web/templates/*.html")
+	files, err := fs.Glob(embedded, "web/templates/*.html")
 	if err != nil { log.Fatalf("templates: %v", err) }
+	tmpl = map[string]*template.Template{}
+	for _, f := range files {
+		name := path.Base(f)
+		if name == "base.html" { continue }
+		t, err := template.New("").Funcs(fns).ParseFS(embedded, "web/templates/base.html", f)
+		if err != nil { log.Fatalf("templates: %v", err) }
+		tmpl[name] = t
+	}
+}
+
+func execTemplate(w io.Writer, name string, data any) error {
+	t, ok := tmpl[name]
+	if !ok { return fmt.Errorf("template %q not found", name) }
+	return t.ExecuteTemplate(w, name, data)
+}
+
+// renderFragment выполняет блок block из набора страницы page — для ответов htmx.
+func renderFragment(w http.ResponseWriter, page, block string, data any) {
+	t, ok := tmpl[page]
+	if !ok { http.Error(w, "render error", 500); return }
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := t.ExecuteTemplate(w, block, data); err != nil {
+		log.Printf("render %s/%s: %v", page, block, err)
+		http.Error(w, "render error", 500)
+	}
+}
+
+// navItems — модули в меню, которые пользователь u может открыть.
+func navItems(u *auth.User) []modules.NavItem {
+	return modules.Default.NavItems(func(m *modules.Module) bool { return canUseModule(u, m) })
+}
+
+// canUseModule — есть ли у пользователя все права, которых требует модуль.
+func canUseModule(u *auth.User, m *modules.Module) bool {
+	if u == nil { return false }
+	for _, p := range m.Permissions() {
+		if !u.Can(p) { return false }
+	}
+	return true
 }
 
 func render(w http.ResponseWriter, r *http.Request, name string, data map[string]any) {
@@ -52,8 +116,10 @@ func render(w http.ResponseWriter, r *http.Request, name string, data map[string
 	data["CurrentUser"] = auth.CtxGet(r)
 	data["CurrentPath"] = r.URL.Path
 	data["Version"] = version
+	data["CSRF"] = auth.CSRFToken(r)
+	data["SSO"] = auth.OIDCLabel()
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	if err := tmpl.ExecuteTemplate(w, name, data); err != nil {
+	if err := execTemplate(w, name, data); err != nil {
 		log.Printf("render %s: %v", name, err)
 		http.Error(w, "render error", 500)
 	}
@@ -67,32 +133,132 @@ func htmlf(w http.ResponseWriter, format string, args ...any) {
 // ── Handlers ──────────────────────────────────────────────────────────────────
 
 func loginGET(w http.ResponseWriter, r *http.Request) {
+	if auth.ProxyAuthenticated(r) { http.Redirect(w,r,"/dashboard",http.StatusFound); return }
+	loginPage(w, r, "login.html", nil)
+}
+
+// loginPage — страницы входа без base.html: CSRF-токен идёт скрытым полем формы.
+func loginPage(w http.ResponseWriter, r *http.Request, page string, data map[string]any) {
+	if data == nil { data = map[string]any{} }
+	data["CSRF"] = auth.CSRFToken(r)
+	data["SSO"] = auth.OIDCLabel()
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	tmpl.ExecuteTemplate(w, "login.html", map[string]any{})
+	execTemplate(w, page, data)
 }
 
 func loginPOST(w http.ResponseWriter, r *http.Request) {
-	user, hash, err := auth.GetByUsername(r.FormValue("username"))
-	if err != nil || !auth.CheckPassword(hash, r.FormValue("password")) || !user.IsActive {
-		if r.Header.Get("HX-Request") == "true" {
-			htmlf(w, `<div class="alert alert-error">Неверный логин или пароль</div>`)
-			return
-		}
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		tmpl.ExecuteTemplate(w, "login.html", map[string]any{"Error": "Неверный логин или пароль"})
+	user, err := auth.Authenticate(r, r.FormValue("username"), r.FormValue("password"))
+	var locked *auth.LockedError
+	switch {
+	case errors.As(err, &locked):
+		loginError(w, r, "login.html", "Слишком много неудачных попыток. Повторите через "+waitText(locked.Wait))
+		return
+	case errors.Is(err, auth.ErrAuthUnavailable):
+		loginError(w, r, "login.html", "Каталог пользователей недоступен. Повторите попытку позже")
+		return
+	case err != nil:
+		loginError(w, r, "login.html", "Неверный логин или пароль")
+		return
+	}
+	completeLogin(w, r, user, r.FormValue("remember") == "1")
+}
+
+// completeLogin — пароль или провайдер уже подтвердили пользователя:
+// дальше второй фактор, если он включён, иначе сразу сессия.
+func completeLogin(w http.ResponseWriter, r *http.Request, user *auth.User, remember bool) {
+	if user.TOTPEnabled {
+		if err := auth.BeginSecondFactor(w, user.ID, remember); err != nil { http.Error(w,err.Error(),500); return }
+		loginRedirect(w, r, "/login/2fa")
 		return
 	}
+	if err := auth.StartSession(w, r, user.ID, remember); err != nil { http.Error(w,err.Error(),500); return }
 	db.DB.Exec(`UPDATE users SET last_login=datetime('now') WHERE id=?`, user.ID)
-	tok, _ := auth.NewToken(user.ID, 24*time.Hour)
-	auth.SetCookie(w, tok)
+	loginRedirect(w, r, "/dashboard")
+}
+
+// loginOIDC уводит на страницу входа провайдера OpenID Connect; он вернёт
+// пользователя на loginOIDCCallback.
+func loginOIDC(w http.ResponseWriter, r *http.Request) {
+	if auth.OIDCLabel() == "" { http.NotFound(w,r); return }
+	to, err := auth.BeginOIDC(w, r)
+	if err != nil {
+		log.Printf("oidc: %v", err)
+		loginPage(w, r, "login.html", map[string]any{"Error": "Провайдер входа недоступен. Повторите попытку позже"})
+		return
+	}
+	http.Redirect(w, r, to, http.StatusFound)
+}
+
+func loginOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if auth.OIDCLabel() == "" { http.NotFound(w,r); return }
+	user, err := auth.FinishOIDC(w, r)
+	msg := ""
+	switch {
+	case errors.Is(err, auth.ErrOIDCState):
+		msg = "Время входа истекло или вход начат в другой вкладке — попробуйте снова"
+	case errors.Is(err, auth.ErrOIDCDenied):
+		log.Printf("%v", err)
+		msg = "Провайдер отклонил вход"
+	case errors.Is(err, auth.ErrBadCredentials):
+		msg = "Для этой учётной записи вход через " + auth.OIDCLabel() + " не разрешён"
+	case errors.Is(err, auth.ErrAuthUnavailable):
+		msg = "Провайдер входа недоступен. Повторите попытку позже"
+	case err != nil:
+		http.Error(w,err.Error(),500); return
+	}
+	if msg != "" { loginPage(w, r, "login.html", map[string]any{"Error": msg}); return }
+	completeLogin(w, r, user, false)
+}
+
+// login2FA — второй шаг входа: код TOTP или код восстановления.
+func login2FA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		if !auth.HasPendingSecondFactor(r) { http.Redirect(w,r,"/login",http.StatusFound); return }
+		loginPage(w, r, "login_2fa.html", nil)
+		return
+	}
+	uid, err := auth.FinishSecondFactor(w, r, r.FormValue("code"))
+	var locked *auth.LockedError
+	switch {
+	case errors.As(err, &locked):
+		loginError(w, r, "login_2fa.html", "Слишком много неудачных попыток. Повторите через "+waitText(locked.Wait))
+		return
+	case errors.Is(err, auth.ErrBadCode):
+		loginError(w, r, "login_2fa.html", "Неверный код")
+		return
+	case errors.Is(err, auth.ErrNoPending):
+		loginError(w, r, "login.html", "Время на ввод кода истекло или попытки исчерпаны — войдите заново")
+		return
+	case err != nil:
+		http.Error(w,err.Error(),500); return
+	}
+	db.DB.Exec(`UPDATE users SET last_login=datetime('now') WHERE id=?`, uid)
+	loginRedirect(w, r, "/dashboard")
+}
+
+func loginError(w http.ResponseWriter, r *http.Request, page, msg string) {
+	if r.Header.Get("HX-Request") == "true" {
+		htmlf(w, `<div class="alert alert-error">%s</div>`, template.HTMLEscapeString(msg))
+		return
+	}
+	loginPage(w, r, page, map[string]any{"Error": msg})
+}
+
+// waitText — «2 мин.», «40 сек.» для сообщений о блокировке.
+func waitText(d time.Duration) string {
+	if d >= time.Minute { return fmt.Sprintf("%d мин.", int((d+time.Minute-1)/time.Minute)) }
+	return fmt.Sprintf("%d сек.", int((d+time.Second-1)/time.Second))
+}
+
+func loginRedirect(w http.ResponseWriter, r *http.Request, to string) {
 	if r.Header.Get("HX-Request") == "true" {
-		w.Header().Set("HX-Redirect", "/dashboard"); w.WriteHeader(200); return
+		w.Header().Set("HX-Redirect", to); w.WriteHeader(200); return
 	}
-	http.Redirect(w, r, "/dashboard", http.StatusFound)
+	http.Redirect(w, r, to, http.StatusFound)
 }
 
 func logout(w http.ResponseWriter, r *http.Request) {
-	http.SetCookie(w, &http.Cookie{Name: "tok", Path: "/", MaxAge: -1})
+	auth.Logout(w, r)
 	http.Redirect(w, r, "/login", http.StatusFound)
 }
 
@@ -131,19 +297,33 @@ func metricsSSE(w http.ResponseWriter, r *http.Request) {
 
 func usersPage(w http.ResponseWriter, r *http.Request) {
 	type Row struct {
-		ID int64; Username,FullName,Email,CreatedAt string; IsAdmin,IsActive bool
+		ID int64; Username,FullName,Email,CreatedAt,AuthSource string; IsAdmin,IsActive,TOTPEnabled bool
+		Roles []string; HasRole map[string]bool
 	}
-	rows, _ := db.DB.Query(`SELECT id,username,full_name,email,is_admin,is_active,created_at FROM users ORDER BY id`)
-	defer rows.Close()
+	rows, _ := db.DB.Query(`SELECT id,username,full_name,email,is_admin,is_active,created_at,totp_enabled,auth_source FROM users ORDER BY id`)
 	var users []Row
 	for rows.Next() {
 		var u Row
-		rows.Scan(&u.ID,&u.Username,&u.FullName,&u.Email,&u.IsAdmin,&u.IsActive,&u.CreatedAt)
+		rows.Scan(&u.ID,&u.Username,&u.FullName,&u.Email,&u.IsAdmin,&u.IsActive,&u.CreatedAt,&u.TOTPEnabled,&u.AuthSource)
 		users = append(users, u)
 	}
-	render(w, r, "users.html", map[string]any{"Users": users})
+	rows.Close()
+	names, _ := auth.UserRoleNames()
+	for i := range users {
+		users[i].Roles, users[i].HasRole = names[users[i].ID], map[string]bool{}
+		for _, n := range users[i].Roles { users[i].HasRole[n] = true }
+	}
+	roles, _ := auth.ListRoles()
+	lockouts, _ := auth.ListLockouts()
+	render(w, r, "users.html", map[string]any{
+		"Users": users, "Roles": roles, "RequireAdmin2FA": db.Setting(auth.SettingRequireAdmin2FA) == "1",
+		"Lockouts": lockouts, "Policy": auth.Policy(),
+	})
 }
 
+// userCreate заводит пользователя. Роли выбирает только обладатель
+// roles.manage, остальные создают пользователей с ролью user: иначе
+// users.manage хватило бы, чтобы завести себе администратора.
 func userCreate(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost { http.NotFound(w,r); return }
 	username := strings.TrimSpace(r.FormValue("username"))
@@ -151,49 +331,271 @@ func userCreate(w http.ResponseWriter, r *http.Request) {
 	if username == "" || password == "" {
 		htmlf(w, `<div class="alert alert-error">Логин и пароль обязательны</div>`); return
 	}
-	hash, _ := auth.HashPassword(password)
-	isAdmin := r.FormValue("is_admin") == "1"
-	_, err := db.DB.Exec(
-		`INSERT INTO users (username,password,full_name,email,is_admin) VALUES (?,?,?,?,?)`,
-		username,hash,r.FormValue("full_name"),r.FormValue("email"),isAdmin,
-	)
-	if err != nil { htmlf(w, `<div class="alert alert-error">Такой логин уже существует</div>`); return }
+	roleIDs := formIDs(r, "role")
+	if !auth.CtxGet(r).Can("roles.manage") {
+		id, err := auth.RoleID(auth.UserRole)
+		if err != nil { http.Error(w,err.Error(),500); return }
+		roleIDs = []int64{id}
+	}
+	if len(roleIDs) == 0 { htmlf(w, `<div class="alert alert-error">Выберите хотя бы одну роль</div>`); return }
+	if !validEmail(strings.TrimSpace(r.FormValue("email"))) { htmlf(w, `<div class="alert alert-error">Некорректный email</div>`); return }
+	if err := auth.ValidatePassword(password); err != nil { htmlf(w, `<div class="alert alert-error">%s</div>`, passwordError(err)); return }
+	_, err := auth.CreateUser(username, password, r.FormValue("full_name"), r.FormValue("email"), roleIDs)
+	switch {
+	case errors.Is(err, auth.ErrUsernameTaken):
+		htmlf(w, `<div class="alert alert-error">Такой логин уже существует</div>`); return
+	case err != nil:
+		htmlf(w, `<div class="alert alert-error">%s</div>`, template.HTMLEscapeString(err.Error())); return
+	}
+	auditLog(r, "user.create", "user:"+username, map[string]any{"roles": roleIDs})
 	w.Header().Set("HX-Refresh", "true")
 }
 
 func userToggle(w http.ResponseWriter, r *http.Request) {
-	id := pathSeg(r.URL.Path, 2)
-	if fmt.Sprint(auth.CtxGet(r).ID) == id { http.Error(w,"cannot modify yourself",400); return }
-	db.DB.Exec(`UPDATE users SET is_active = NOT is_active WHERE id=?`, id)
+	id, err := strconv.ParseInt(pathSeg(r.URL.Path, 2), 10, 64)
+	if err != nil { http.NotFound(w,r); return }
+	if auth.CtxGet(r).ID == id { http.Error(w,"cannot modify yourself",400); return }
+	if !canManageUser(w, r, id) { return }
+	if err := auth.ToggleUserActive(id); err != nil { userError(w, err); return }
+	auditLog(r, "user.toggle", userTarget(id), nil)
+	w.Header().Set("HX-Refresh", "true")
+}
+
+// userError — ответ на неудачное действие с пользователем; текст показывается во всплывающем сообщении.
+func userError(w http.ResponseWriter, err error) {
+	if errors.Is(err, auth.ErrLastAdmin) { http.Error(w, "Должен остаться хотя бы один активный администратор", http.StatusConflict); return }
+	if errors.Is(err, auth.ErrAdminTarget) { http.Error(w, "Учётную запись администратора может менять только администратор", http.StatusForbidden); return }
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+// canManageUser отвечает 403 и возвращает false, если текущий пользователь не
+// может менять пользователя id (см. auth.CheckManageUser).
+func canManageUser(w http.ResponseWriter, r *http.Request, id int64) bool {
+	if err := auth.CheckManageUser(auth.CtxGet(r), id); err != nil { userError(w, err); return false }
+	return true
+}
+
+// userEdit — логин, имя, email и (с roles.manage, не себе) роли пользователя.
+func userEdit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost { http.NotFound(w,r); return }
+	id, err := strconv.ParseInt(pathSeg(r.URL.Path, 2), 10, 64)
+	if err != nil { http.NotFound(w,r); return }
+	fail := func(msg string) { htmlf(w, `<div class="alert alert-error">%s</div>`, msg) }
+	u := auth.CtxGet(r)
+	if !canManageUser(w, r, id) { return }
+	username := strings.TrimSpace(r.FormValue("username"))
+	fullName, email := strings.TrimSpace(r.FormValue("full_name")), strings.TrimSpace(r.FormValue("email"))
+	if username == "" { fail("Логин обязателен"); return }
+	if !validEmail(email) { fail("Некорректный email"); return }
+	details := map[string]any{"username": username, "full_name": fullName, "email": email}
+	var roleIDs []int64
+	if r.FormValue("set_roles") == "1" {
+		if !u.Can("roles.manage") { http.Error(w,"forbidden",403); return }
+		if u.ID == id { fail("Свои роли изменить нельзя"); return }
+		roleIDs = formIDs(r, "role")
+		if roleIDs == nil { roleIDs = []int64{} }
+		details["roles"] = roleIDs
+	}
+	target := userTarget(id)
+	switch err := auth.UpdateUser(id, username, fullName, email, roleIDs); {
+	case errors.Is(err, auth.ErrUsernameTaken): fail("Такой логин уже существует"); return
+	case errors.Is(err, auth.ErrExternalLogin): fail("Логин пользователя из внешнего каталога меняется в каталоге"); return
+	case errors.Is(err, auth.ErrNoRoles): fail("Выберите хотя бы одну роль"); return
+	case errors.Is(err, auth.ErrLastAdmin): fail("Нельзя снять роль admin с последнего активного администратора"); return
+	case err != nil: fail(template.HTMLEscapeString(err.Error())); return
+	}
+	auditLog(r, "user.update", target, details)
+	w.Header().Set("HX-Refresh", "true")
+}
+
+// userPassword — сброс пароля администратором: заданный или случайный,
+// сменить его нужно при следующем входе. Сеансы пользователя завершаются.
+func userPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost { http.NotFound(w,r); return }
+	id, err := strconv.ParseInt(pathSeg(r.URL.Path, 2), 10, 64)
+	if err != nil { http.NotFound(w,r); return }
+	if auth.CtxGet(r).ID == id { http.Error(w,"use /profile to change your own password",400); return }
+	if !canManageUser(w, r, id) { return }
+	if t, err := auth.GetByID(id); err == nil && t.ExternalSource() {
+		htmlf(w, `<div class="alert alert-error">%s</div>`, passwordError(auth.ErrExternalAccount)); return
+	}
+	password := r.FormValue("password")
+	if password == "" {
+		password = auth.RandomPassword()
+	} else if err := auth.ValidatePassword(password); err != nil {
+		htmlf(w, `<div class="alert alert-error">%s</div>`, passwordError(err)); return
+	}
+	if err := auth.SetPassword(id, password, true); err != nil { http.Error(w,err.Error(),500); return }
+	auth.RevokeUserSessions(id, "")
+	auditLog(r, "user.password_reset", userTarget(id), map[string]any{"generated": r.FormValue("password") == ""})
+	if r.FormValue("password") != "" {
+		htmlf(w, `<div class="alert alert-success">Пароль сброшен. Пользователь сменит его при следующем входе.</div>`); return
+	}
+	htmlf(w, `<div class="alert alert-success">Временный пароль: <code>%s</code><br>Он показывается один раз; пользователь сменит его при следующем входе.</div>`, template.HTMLEscapeString(password))
+}
+
+func userRoles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost { http.NotFound(w,r); return }
+	id, err := strconv.ParseInt(pathSeg(r.URL.Path, 2), 10, 64)
+	if err != nil { http.NotFound(w,r); return }
+	if auth.CtxGet(r).ID == id { http.Error(w,"cannot modify yourself",400); return }
+	if err := auth.SetUserRoles(id, formIDs(r, "role")); err != nil { http.Error(w,err.Error(),400); return }
+	auditLog(r, "user.roles", userTarget(id), map[string]any{"roles": formIDs(r, "role")})
+	w.Header().Set("HX-Refresh", "true")
+}
+
+// userSessions завершает все сессии пользователя («выйти везде»).
+func userSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost { http.NotFound(w,r); return }
+	id, err := strconv.ParseInt(pathSeg(r.URL.Path, 2), 10, 64)
+	if err != nil { http.NotFound(w,r); return }
+	if !canManageUser(w, r, id) { return }
+	if err := auth.RevokeUserSessions(id, ""); err != nil { http.Error(w,err.Error(),500); return }
+	auditLog(r, "user.sessions_revoke", userTarget(id), nil)
+	w.Header().Set("HX-Refresh", "true")
+}
+
+// userReset2FA отключает 2FA пользователю, потерявшему телефон и коды восстановления.
+func userReset2FA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost { http.NotFound(w,r); return }
+	id, err := strconv.ParseInt(pathSeg(r.URL.Path, 2), 10, 64)
+	if err != nil { http.NotFound(w,r); return }
+	if !canManageUser(w, r, id) { return }
+	if err := auth.DisableTOTP(id); err != nil { http.Error(w,err.Error(),500); return }
+	auditLog(r, "user.2fa_reset", userTarget(id), nil)
+	w.Header().Set("HX-Refresh", "true")
+}
+
+// userUnlock снимает блокировку входа: поля scope (ip | user) и key.
+func userUnlock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost { http.NotFound(w,r); return }
+	if err := auth.Unlock(r.FormValue("scope"), r.FormValue("key")); err != nil { http.Error(w,err.Error(),400); return }
+	auditLog(r, "auth.unlock", r.FormValue("scope")+":"+r.FormValue("key"), nil)
+	w.Header().Set("HX-Refresh", "true")
+}
+
+func securitySettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost { http.NotFound(w,r); return }
+	v := "0"
+	if r.FormValue("require_admin_2fa") == "1" { v = "1" }
+	if err := db.SetSetting(auth.SettingRequireAdmin2FA, v); err != nil { http.Error(w,err.Error(),500); return }
+	auditLog(r, "settings.update", "setting:"+auth.SettingRequireAdmin2FA, map[string]any{"value": v})
 	w.Header().Set("HX-Refresh", "true")
 }
 
 func userDelete(w http.ResponseWriter, r *http.Request) {
-	id := pathSeg(r.URL.Path, 2)
-	if fmt.Sprint(auth.CtxGet(r).ID) == id { http.Error(w,"cannot delete yourself",400); return }
-	db.DB.Exec(`DELETE FROM users WHERE id=?`, id)
+	id, err := strconv.ParseInt(pathSeg(r.URL.Path, 2), 10, 64)
+	if err != nil { http.NotFound(w,r); return }
+	if auth.CtxGet(r).ID == id { http.Error(w,"cannot delete yourself",400); return }
+	if !canManageUser(w, r, id) { return }
+	target := userTarget(id)
+	if err := auth.DeleteUser(id); err != nil { userError(w, err); return }
+	auditLog(r, "user.delete", target, nil)
+	w.Header().Set("HX-Refresh", "true")
+}
+
+// permissionChoices — права для галочек в форме роли: каталог портала и права модулей.
+func permissionChoices() []auth.PermissionInfo {
+	out := append([]auth.PermissionInfo{}, auth.Catalog...)
+	seen := map[string]bool{}
+	for _, p := range out { seen[p.Name] = true }
+	var extra []string
+	for _, m := range modules.Default.All() {
+		for _, p := range m.Permissions() {
+			if !seen[p] { seen[p] = true; extra = append(extra, p) }
+		}
+	}
+	sort.Strings(extra)
+	for _, p := range extra { out = append(out, auth.PermissionInfo{Name: p, Label: "Модуль"}) }
+	return out
+}
+
+func rolesPage(w http.ResponseWriter, r *http.Request) {
+	type Row struct {
+		auth.Role
+		Users int
+		Extra string // права вне списка галочек: маски и права удалённых модулей
+	}
+	roles, err := auth.ListRoles()
+	if err != nil { http.Error(w,err.Error(),500); return }
+	choices := permissionChoices()
+	known := map[string]bool{}
+	for _, p := range choices { known[p.Name] = true }
+	var out []Row
+	for _, role := range roles {
+		row := Row{Role: role}
+		db.DB.QueryRow(`SELECT COUNT(*) FROM user_roles WHERE role_id=?`, role.ID).Scan(&row.Users)
+		var extra []string
+		for _, p := range role.Permissions {
+			if !known[p] { extra = append(extra, p) }
+		}
+		row.Extra = strings.Join(extra, " ")
+		out = append(out, row)
+	}
+	render(w, r, "roles.html", map[string]any{"Roles": out, "Permissions": choices})
+}
+
+// rolePermissions собирает права из формы: галочки perm и поле extra через пробел или запятую.
+func rolePermissions(r *http.Request) []string {
+	r.ParseForm()
+	perms := append([]string{}, r.Form["perm"]...)
+	perms = append(perms, strings.Fields(strings.ReplaceAll(r.FormValue("extra"), ",", " "))...)
+	return perms
+}
+
+func roleCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost { http.NotFound(w,r); return }
+	name, perms := strings.TrimSpace(r.FormValue("name")), rolePermissions(r)
+	err := auth.CreateRole(name, r.FormValue("description"), perms)
+	if err != nil { htmlf(w, `<div class="alert alert-error">%s</div>`, template.HTMLEscapeString(err.Error())); return }
+	auditLog(r, "role.create", "role:"+name, map[string]any{"permissions": perms})
+	w.Header().Set("HX-Refresh", "true")
+}
+
+func roleUpdate(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(pathSeg(r.URL.Path, 2), 10, 64)
+	if err != nil { http.NotFound(w,r); return }
+	perms := rolePermissions(r)
+	if err := auth.UpdateRole(id, r.FormValue("description"), perms); err != nil {
+		htmlf(w, `<div class="alert alert-error">%s</div>`, template.HTMLEscapeString(err.Error())); return
+	}
+	auditLog(r, "role.update", roleTarget(id), map[string]any{"permissions": perms})
+	w.Header().Set("HX-Refresh", "true")
+}
+
+func roleDelete(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(pathSeg(r.URL.Path, 2), 10, 64)
+	if err != nil { http.NotFound(w,r); return }
+	target := roleTarget(id)
+	if err := auth.DeleteRole(id); err != nil { http.Error(w,err.Error(),400); return }
+	auditLog(r, "role.delete", target, nil)
 	w.Header().Set("HX-Refresh", "true")
 }
 
 func modulesPage(w http.ResponseWriter, r *http.Request) {
 	type Row struct {
 		ID int64; Name,Version,Description,Author,Status,SourceType,InstalledAt,ErrorLog string
+		RestartCount,Port int; LastExitCode sql.NullInt64
+		Permissions []string
 	}
-	rows, _ := db.DB.Query(`SELECT id,name,version,description,author,status,source_type,installed_at,error_log FROM modules ORDER BY name`)
+	rows, _ := db.DB.Query(`SELECT id,name,version,description,author,status,source_type,installed_at,error_log,restart_count,last_exit_code,port FROM modules ORDER BY name`)
 	defer rows.Close()
 	var mods []Row
 	for rows.Next() {
 		var m Row
-		rows.Scan(&m.ID,&m.Name,&m.Version,&m.Description,&m.Author,&m.Status,&m.SourceType,&m.InstalledAt,&m.ErrorLog)
+		rows.Scan(&m.ID,&m.Name,&m.Version,&m.Description,&m.Author,&m.Status,&m.SourceType,&m.InstalledAt,&m.ErrorLog,&m.RestartCount,&m.LastExitCode,&m.Port)
+		if mod, ok := modules.Default.Get(m.Name); ok { m.Permissions = mod.Permissions() }
 		mods = append(mods, m)
 	}
-	render(w, r, "modules.html", map[string]any{"Modules": mods})
+	roles, _ := auth.ListRoles()
+	render(w, r, "modules.html", map[string]any{"Modules": mods, "Roles": roles})
 }
 
 func moduleInstallGitHub(w http.ResponseWriter, r *http.Request) {
 	repoURL := strings.TrimSpace(r.FormValue("url"))
 	if repoURL == "" { htmlf(w, `<div class="alert alert-error">URL обязателен</div>`); return }
 	task := modules.Default.InstallGitHub(r.Context(), repoURL)
+	auditLog(r, "module.install", repoURL, map[string]any{"source": "github", "task": task.ID})
 	htmlf(w, `<div class="install-log" hx-ext="sse" sse-connect="/modules/install/%s/stream" sse-swap="message" hx-target="#install-lines" hx-swap="beforeend"><div id="install-lines" style="font-family:monospace;font-size:12px"></div></div>`, task.ID)
 }
 
@@ -211,6 +613,7 @@ func moduleInstallZip(w http.ResponseWriter, r *http.Request) {
 	for { n,err := file.Read(buf); if n>0{f.Write(buf[:n])}; if err!=nil{break} }
 	f.Close()
 	task := modules.Default.InstallZip(r.Context(), tmp)
+	auditLog(r, "module.install", hdr.Filename, map[string]any{"source": "zip", "size": hdr.Size, "task": task.ID})
 	htmlf(w, `<div class="install-log" hx-ext="sse" sse-connect="/modules/install/%s/stream" sse-swap="message" hx-target="#install-lines" hx-swap="beforeend"><div id="install-lines" style="font-family:monospace;font-size:12px"></div></div>`, task.ID)
 }
 
@@ -223,17 +626,49 @@ func moduleInstallStream(w http.ResponseWriter, r *http.Request) {
 
 func moduleActivate(w http.ResponseWriter, r *http.Request) {
 	name := pathSeg(r.URL.Path, 2)
-	if err := modules.Default.Activate(name); err != nil { http.Error(w,err.Error(),500); return }
+	err := modules.Default.Activate(name)
+	auditLog(r, "module.activate", "module:"+name, errDetails(err))
+	if err != nil { http.Error(w,err.Error(),500); return }
 	w.Header().Set("HX-Refresh","true")
 }
 
 func moduleDeactivate(w http.ResponseWriter, r *http.Request) {
-	modules.Default.Deactivate(pathSeg(r.URL.Path, 2))
+	name := pathSeg(r.URL.Path, 2)
+	modules.Default.Deactivate(name)
+	auditLog(r, "module.deactivate", "module:"+name, nil)
+	w.Header().Set("HX-Refresh","true")
+}
+
+// moduleAccess выдаёт ролям права модуля: поле grant = "<role_id>:<permission>"
+// для каждой отмеченной пары. Роли, покрывающие право маской, не трогаем.
+func moduleAccess(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost { http.NotFound(w,r); return }
+	mod, ok := modules.Default.Get(pathSeg(r.URL.Path, 2))
+	if !ok { http.NotFound(w,r); return }
+	r.ParseForm()
+	granted := map[string]bool{}
+	for _, g := range r.Form["grant"] { granted[g] = true }
+	roles, err := auth.ListRoles()
+	if err != nil { http.Error(w,err.Error(),500); return }
+	var changes []string
+	for _, role := range roles {
+		for _, p := range mod.Permissions() {
+			on := granted[fmt.Sprintf("%d:%s", role.ID, p)]
+			if role.Grants(p) == on || (!role.Grants(p) && role.Covers(p)) { continue }
+			if err := auth.SetRolePermission(role.ID, p, on); err != nil { http.Error(w,err.Error(),500); return }
+			sign := "-"
+			if on { sign = "+" }
+			changes = append(changes, role.Name+" "+sign+p)
+		}
+	}
+	if len(changes) > 0 { auditLog(r, "module.access", "module:"+mod.Name, map[string]any{"changes": changes}) }
 	w.Header().Set("HX-Refresh","true")
 }
 
 func moduleDelete(w http.ResponseWriter, r *http.Request) {
-	modules.Default.Delete(pathSeg(r.URL.Path, 2))
+	name := pathSeg(r.URL.Path, 2)
+	err := modules.Default.Delete(name)
+	auditLog(r, "module.delete", "module:"+name, errDetails(err))
 	w.Header().Set("HX-Refresh","true")
 }
 
@@ -241,7 +676,11 @@ func moduleView(w http.ResponseWriter, r *http.Request) {
 	name := pathSeg(r.URL.Path, 2)
 	mod, ok := modules.Default.Get(name)
 	if !ok { render(w,r,"module_frame.html",map[string]any{"ModuleName":name,"Error":"Модуль не найден"}); return }
-	if mod.Status != "active" {
+	if !canUseModule(auth.CtxGet(r), mod) {
+		w.WriteHeader(http.StatusForbidden)
+		render(w,r,"module_frame.html",map[string]any{"ModuleName":name,"Error":"Нет доступа к модулю"}); return
+	}
+	if !modules.IsRunning(mod.Status) || mod.Status == "restarting" {
 		render(w,r,"module_frame.html",map[string]any{"ModuleName":name,"Error":"Модуль не активен ("+mod.Status+")"}); return
 	}
 	render(w,r,"module_frame.html",map[string]any{"ModuleName":name})
@@ -250,22 +689,156 @@ func moduleView(w http.ResponseWriter, r *http.Request) {
 func moduleProxy(w http.ResponseWriter, r *http.Request) {
 	name := pathSeg(r.URL.Path, 2)
 	mod, ok := modules.Default.Get(name)
-	if !ok || mod.Status != "active" { http.Error(w,"module unavailable",503); return }
-	if mod.Manifest == nil || mod.Manifest.Port == 0 { http.Error(w,"module has no HTTP port",502); return }
-	subPath := strings.TrimPrefix(r.URL.Path, "/module-proxy/"+name)
-	if subPath == "" { subPath = "/" }
-	target := fmt.Sprintf("http://127.0.0.1:%d%s", mod.Manifest.Port, subPath)
-	if r.URL.RawQuery != "" { target += "?"+r.URL.RawQuery }
-	req, err := http.NewRequestWithContext(r.Context(), r.Method, target, r.Body)
-	if err != nil { http.Error(w,err.Error(),500); return }
-	for k,vv := range r.Header { req.Header[k]=vv }
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil { http.Error(w,"module unreachable",502); return }
-	defer resp.Body.Close()
-	for k,vv := range resp.Header { for _,v := range vv { w.Header().Add(k,v) } }
-	w.WriteHeader(resp.StatusCode)
-	buf := make([]byte, 32*1024)
-	for { n,err:=resp.Body.Read(buf); if n>0{w.Write(buf[:n])}; if err!=nil{break} }
+	if ok && !canUseModule(auth.CtxGet(r), mod) { http.Error(w,"403 Forbidden",http.StatusForbidden); return }
+	if ok && mod.Status == "starting" {
+		// iframe показывает заглушку, которая сама перезагрузится, когда модуль поднимется
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Retry-After", "2")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		execTemplate(w, "module_starting.html", map[string]any{"ModuleName": name})
+		return
+	}
+	if !ok || !modules.IsServing(mod.Status) { http.Error(w,"module unavailable",503); return }
+	if !mod.HasUpstream() { http.Error(w,"module has no HTTP port",502); return }
+	u := auth.CtxGet(r)
+	ip := auth.ClientIP(r)
+	auth.StripCredentials(r)
+	mod.ServeProxy(w, r, modules.Identity{UserID: u.ID, Username: u.Username, Roles: u.Roles, ClientIP: ip})
+}
+
+func passwordPage(w http.ResponseWriter, r *http.Request) {
+	render(w, r, "password.html", map[string]any{"Policy": auth.Policy()})
+}
+
+// changePassword — смена своего пароля (форма в профиле и обязательная смена).
+func changePassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost { http.NotFound(w,r); return }
+	u := auth.CtxGet(r)
+	err := auth.ChangePassword(u.ID, r.FormValue("old_password"), r.FormValue("new_password"))
+	switch {
+	case errors.Is(err, auth.ErrBadCredentials):
+		htmlf(w, `<div class="alert alert-error">Текущий пароль неверен</div>`); return
+	case errors.Is(err, auth.ErrSamePassword):
+		htmlf(w, `<div class="alert alert-error">Новый пароль должен отличаться от текущего</div>`); return
+	case err != nil:
+		htmlf(w, `<div class="alert alert-error">%s</div>`, passwordError(err)); return
+	}
+	// Остальные сеансы могли быть открыты со старым паролем
+	auth.RevokeUserSessions(u.ID, u.SessionID())
+	dropInitialPassword(r.FormValue("old_password"))
+	auditLog(r, "profile.password", "user:"+u.Username, nil)
+	if u.MustChangePassword { w.Header().Set("HX-Redirect", "/"); return }
+	htmlf(w, `<div class="alert alert-success">Пароль изменён</div>`)
+}
+
+// passwordError — текст ошибки проверки пароля для пользователя.
+func passwordError(err error) string {
+	p := auth.Policy()
+	switch {
+	case errors.Is(err, auth.ErrPasswordTooShort):
+		return fmt.Sprintf("Пароль должен быть не короче %d символов", p.MinLength)
+	case errors.Is(err, auth.ErrPasswordTooSimple):
+		return fmt.Sprintf("Пароль должен содержать символы хотя бы %d видов из: строчные, заглавные, цифры, прочие", p.MinClasses)
+	case errors.Is(err, auth.ErrPasswordBreached):
+		return "Этот пароль встречается в утёкших базах — выберите другой"
+	case errors.Is(err, auth.ErrExternalAccount):
+		return "Пароль этой учётной записи хранится во внешнем каталоге (LDAP) и меняется там"
+	}
+	return template.HTMLEscapeString(err.Error())
+}
+
+// profileUpdate — смена своих имени и email.
+func profileUpdate(w http.ResponseWriter, r *http.Request) {
+	u := auth.CtxGet(r)
+	fullName, email := strings.TrimSpace(r.FormValue("full_name")), strings.TrimSpace(r.FormValue("email"))
+	if !validEmail(email) { htmlf(w, `<div class="alert alert-error">Некорректный email</div>`); return }
+	if len([]rune(fullName)) > 100 { htmlf(w, `<div class="alert alert-error">Имя слишком длинное</div>`); return }
+	if err := auth.UpdateProfile(u.ID, fullName, email); err != nil { http.Error(w,err.Error(),500); return }
+	auditLog(r, "profile.update", "user:"+u.Username, map[string]any{"full_name": fullName, "email": email})
+	htmlf(w, `<div class="alert alert-success">Сохранено</div>`)
+}
+
+func profilePage(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost { profileUpdate(w, r); return }
+	u := auth.CtxGet(r)
+	tokens, _ := auth.ListAPITokens(u.ID)
+	sessions, _ := auth.ListSessions(u.ID)
+	for i := range sessions { sessions[i].Current = sessions[i].ID == u.SessionID() }
+	render(w, r, "profile.html", map[string]any{
+		"Tokens": tokens, "Scopes": auth.Catalog, "Sessions": sessions, "Policy": auth.Policy(),
+		"RecoveryLeft": auth.RecoveryCodesLeft(u.ID), "TwoFactorRequired": auth.TwoFactorRequired(u),
+	})
+}
+
+// profile2FA — /profile/2fa/{setup,enable,disable,recovery}.
+func profile2FA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost { http.NotFound(w,r); return }
+	u := auth.CtxGet(r)
+	fail := func(msg string) { htmlf(w, `<div class="alert alert-error">%s</div>`, msg) }
+	switch pathSeg(r.URL.Path, 3) {
+	case "setup":
+		if u.TOTPEnabled { fail("2FA уже включена"); return }
+		secret, uri, err := auth.StartTOTPSetup(u.ID, u.Username)
+		if err != nil { http.Error(w,err.Error(),500); return }
+		img, err := auth.QRDataURI(uri)
+		if err != nil { http.Error(w,err.Error(),500); return }
+		renderFragment(w, "profile.html", "totp-setup", map[string]any{"Secret": secret, "QR": template.URL(img)})
+	case "enable":
+		codes, err := auth.EnableTOTP(u.ID, r.FormValue("code"))
+		if errors.Is(err, auth.ErrBadCode) { fail("Неверный код — проверьте время на телефоне"); return }
+		if err != nil { http.Error(w,err.Error(),500); return }
+		auditLog(r, "profile.2fa_enable", "user:"+u.Username, nil)
+		renderFragment(w, "profile.html", "recovery-codes", map[string]any{"Codes": codes})
+	case "recovery":
+		if err := auth.VerifySecondFactor(u.ID, r.FormValue("code")); err != nil { fail("Неверный код"); return }
+		codes, err := auth.RegenerateRecoveryCodes(u.ID)
+		if err != nil { http.Error(w,err.Error(),500); return }
+		auditLog(r, "profile.2fa_recovery", "user:"+u.Username, nil)
+		renderFragment(w, "profile.html", "recovery-codes", map[string]any{"Codes": codes})
+	case "disable":
+		if u.IsAdmin && db.Setting(auth.SettingRequireAdmin2FA) == "1" { fail("Администраторам 2FA обязательна"); return }
+		if err := auth.VerifySecondFactor(u.ID, r.FormValue("code")); err != nil { fail("Неверный код"); return }
+		if err := auth.DisableTOTP(u.ID); err != nil { http.Error(w,err.Error(),500); return }
+		auditLog(r, "profile.2fa_disable", "user:"+u.Username, nil)
+		w.Header().Set("HX-Refresh", "true")
+	default:
+		http.NotFound(w,r)
+	}
+}
+
+// sessionRevoke: DELETE /profile/sessions/<id> — одна сессия, DELETE /profile/sessions — все, кроме текущей.
+func sessionRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete { http.NotFound(w,r); return }
+	u := auth.CtxGet(r)
+	if sid := pathSeg(r.URL.Path, 3); sid != "" {
+		if err := auth.RevokeSession(u.ID, sid); err != nil { http.NotFound(w,r); return }
+		auditLog(r, "profile.session_revoke", "user:"+u.Username, nil)
+	} else if err := auth.RevokeUserSessions(u.ID, u.SessionID()); err != nil {
+		http.Error(w,err.Error(),500); return
+	} else {
+		auditLog(r, "profile.sessions_revoke", "user:"+u.Username, nil)
+	}
+	w.Header().Set("HX-Refresh", "true")
+}
+
+func tokenCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost { http.NotFound(w,r); return }
+	r.ParseForm()
+	days, _ := strconv.Atoi(r.FormValue("days"))
+	plain, err := auth.CreateAPIToken(auth.CtxGet(r), r.FormValue("name"), r.Form["scope"], time.Duration(days)*24*time.Hour)
+	if errors.Is(err, auth.ErrTokenViaToken) { http.Error(w,"403 Forbidden: "+err.Error(),http.StatusForbidden); return }
+	if err != nil { htmlf(w, `<div class="alert alert-error">%s</div>`, template.HTMLEscapeString(err.Error())); return }
+	auditLog(r, "token.create", "token:"+strings.TrimSpace(r.FormValue("name")), map[string]any{"scopes": r.Form["scope"], "days": days})
+	htmlf(w, `<div class="alert alert-success">Токен создан. Скопируйте его сейчас — больше он показан не будет:<br><code>%s</code><br><a href="/profile">Обновить список</a></div>`, plain)
+}
+
+func tokenRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete { http.NotFound(w,r); return }
+	id, err := strconv.ParseInt(pathSeg(r.URL.Path, 3), 10, 64)
+	if err != nil { http.NotFound(w,r); return }
+	if err := auth.RevokeAPIToken(auth.CtxGet(r).ID, id); err != nil { http.NotFound(w,r); return }
+	auditLog(r, "token.revoke", fmt.Sprintf("token:#%d", id), nil)
+	w.Header().Set("HX-Refresh", "true")
 }
 
 func logsPage(w http.ResponseWriter, r *http.Request) {
@@ -275,6 +848,125 @@ func logsPage(w http.ResponseWriter, r *http.Request) {
 	render(w, r, "logs.html", map[string]any{"Lines": lines})
 }
 
+const auditPageSize = 50
+
+func auditFilter(r *http.Request) audit.Filter {
+	q := r.URL.Query()
+	return audit.Filter{
+		Actor: strings.TrimSpace(q.Get("actor")), Action: q.Get("action"), Target: strings.TrimSpace(q.Get("target")),
+		From: q.Get("from"), To: q.Get("to"),
+	}
+}
+
+func auditPage(w http.ResponseWriter, r *http.Request) {
+	f := auditFilter(r)
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 { page = 1 }
+	events, total, err := audit.Query(f, auditPageSize, (page-1)*auditPageSize)
+	if err != nil { http.Error(w,err.Error(),500); return }
+	actions, _ := audit.Actions()
+	// Ссылки на соседние страницы и выгрузку сохраняют фильтр
+	q := r.URL.Query()
+	q.Del("page")
+	pageURL := func(n int) string { q.Set("page", strconv.Itoa(n)); return "/audit?" + q.Encode() }
+	q.Del("page")
+	data := map[string]any{
+		"Events": events, "Total": total, "Filter": f, "Actions": actions, "Page": page,
+		"Export": template.URL(q.Encode()),
+	}
+	if page > 1 { data["PrevURL"] = pageURL(page-1) }
+	if page*auditPageSize < total { data["NextURL"] = pageURL(page+1) }
+	render(w, r, "audit.html", data)
+}
+
+// csvSafe не даёт табличным редакторам принять значение за формулу:
+// логин неудачного входа, например, вводит кто угодно.
+func csvSafe(v string) string {
+	if v != "" && strings.ContainsRune("=+-@\t\r", rune(v[0])) { return "'" + v }
+	return v
+}
+
+// auditExport выгружает события по фильтру страницы: ?format=csv или jsonl.
+func auditExport(w http.ResponseWriter, r *http.Request) {
+	f := auditFilter(r)
+	name := "audit-" + time.Now().Format("20060102-150405")
+	switch r.URL.Query().Get("format") {
+	case "jsonl":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.jsonl"`)
+		enc := json.NewEncoder(w)
+		audit.Each(f, func(e audit.Event) error { return enc.Encode(e) })
+	case "csv", "":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.csv"`)
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"id","time","user_id","actor","action","target","ip","details"})
+		audit.Each(f, func(e audit.Event) error {
+			return cw.Write([]string{strconv.FormatInt(e.ID,10), e.Time, strconv.FormatInt(e.UserID,10), csvSafe(e.Actor), e.Action, csvSafe(e.Target), e.IP, e.DetailsText()})
+		})
+		cw.Flush()
+	default:
+		http.Error(w,"format must be csv or jsonl",400)
+	}
+}
+
+// ── Backup ────────────────────────────────────────────────────────────────────
+
+func backupPage(w http.ResponseWriter, r *http.Request) {
+	var size int64
+	for _, suffix := range []string{"", "-wal"} {
+		if st, err := os.Stat(filepath.Join(cfg.DataDir, db.FileName+suffix)); err == nil { size += st.Size() }
+	}
+	version, _ := db.SchemaVersion(db.DB)
+	data := map[string]any{"Version": version, "Size": fmt.Sprintf("%.1f МБ", float64(size)/(1<<20))}
+	if st := db.PendingRestore(cfg.DataDir); st != nil {
+		data["Pending"] = st.ModTime().Format("02.01.2006 15:04")
+	}
+	render(w, r, "backup.html", data)
+}
+
+// backupDownload отдаёт согласованный снимок базы; временный файл — в каталоге
+// данных, а не в /tmp: база бывает больше tmpfs.
+func backupDownload(w http.ResponseWriter, r *http.Request) {
+	tmp := filepath.Join(cfg.DataDir, fmt.Sprintf(".backup-%d.db", time.Now().UnixNano()))
+	defer os.Remove(tmp)
+	if err := db.Backup(tmp); err != nil {
+		auditLog(r, "db.backup", "", errDetails(err))
+		http.Error(w,err.Error(),500); return
+	}
+	f, err := os.Open(tmp)
+	if err != nil { http.Error(w,err.Error(),500); return }
+	defer f.Close()
+	st, _ := f.Stat()
+	auditLog(r, "db.backup", "", map[string]any{"size": st.Size()})
+	w.Header().Set("Content-Type", "application/vnd.sqlite3")
+	w.Header().Set("Content-Disposition", `attachment; filename="hopefully-`+time.Now().Format("20060102-150405")+`.db"`)
+	http.ServeContent(w, r, "", st.ModTime(), f)
+}
+
+// backupRestore проверяет загруженную копию и готовит её к подмене базы при
+// следующем запуске.
+func backupRestore(w http.ResponseWriter, r *http.Request) {
+	file, hdr, err := r.FormFile("file")
+	if err != nil { htmlf(w, `<div class="alert alert-error">Файл не получен</div>`); return }
+	defer file.Close()
+	info, err := db.StageRestore(cfg.DataDir, file)
+	if err != nil {
+		auditLog(r, "db.restore_staged", hdr.Filename, errDetails(err))
+		msg := "Копия не принята: " + err.Error()
+		if errors.Is(err, db.ErrSchemaTooNew) { msg = "Копия сделана более новой версией Hopefully — сначала обновите портал" }
+		htmlf(w, `<div class="alert alert-error">%s</div>`, template.HTMLEscapeString(msg)); return
+	}
+	auditLog(r, "db.restore_staged", hdr.Filename, map[string]any{"schema_version": info.Version, "users": info.Users, "size": hdr.Size})
+	w.Header().Set("HX-Refresh", "true")
+}
+
+func backupRestoreCancel(w http.ResponseWriter, r *http.Request) {
+	if err := db.CancelRestore(cfg.DataDir); err != nil { http.Error(w,err.Error(),500); return }
+	auditLog(r, "db.restore_cancelled", "", nil)
+	w.Header().Set("HX-Refresh", "true")
+}
+
 // ── Router ─────────────────────────────────────────────────────────────────────
 
 func newRouter() http.Handler {
@@ -286,82 +978,228 @@ func newRouter() http.Handler {
 		http.FileServer(http.Dir(filepath.Join(cfg.DataDir,"modules")))))
 
 	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method { case http.MethodGet: loginGET(w,r); case http.MethodPost: loginPOST(w,r) }
+		switch r.Method { case http.MethodGet: loginGET(w,r); case http.MethodPost: loginPOST(w,r); default: notAllowed(w) }
 	})
-	mux.HandleFunc("/logout", logout)
+	mux.HandleFunc("/login/2fa", login2FA)
+	mux.HandleFunc("/login/oidc", only(http.MethodGet, loginOIDC))
+	mux.HandleFunc(auth.OIDCCallbackPath, only(http.MethodGet, loginOIDCCallback))
+	mux.HandleFunc("/logout", only(http.MethodPost, logout))
 	mux.HandleFunc("/api/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type","application/json")
 		fmt.Fprintf(w,`{"status":"ok","version":"%s"}`,version)
 	})
 
-	a_ := func(h http.HandlerFunc) http.Handler { return auth.Middleware(http.HandlerFunc(h)) }
-	ad := func(h http.HandlerFunc) http.Handler { return auth.AdminOnly(http.HandlerFunc(h)) }
+	// a_ аутентифицирует, p_ — ещё и проверяет право. Внутри уже
+	// аутентифицированного маршрута — только can_, без повторного входа.
+	can_ := func(perm string, h http.HandlerFunc) http.Handler { return auth.RequirePermission(perm)(h) }
+	a_ := func(h http.HandlerFunc) http.Handler { return auth.Middleware(h) }
+	p_ := func(perm string, h http.HandlerFunc) http.Handler { return auth.Middleware(can_(perm, h)) }
+	post, del := http.MethodPost, http.MethodDelete
 
 	mux.Handle("/", a_(func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/" { http.Redirect(w,r,"/dashboard",http.StatusFound); return }
 		http.NotFound(w,r)
 	}))
-	mux.Handle("/dashboard", a_(dashboard))
-	mux.Handle("/dashboard/metrics", a_(metricsSSE))
+	mux.Handle("/dashboard", p_("dashboard.view", dashboard))
+	mux.Handle("/dashboard/metrics", p_("dashboard.view", metricsSSE))
 
-	mux.Handle("/users", a_(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodPost { ad(userCreate).ServeHTTP(w,r) } else { usersPage(w,r) }
+	mux.Handle("/users", p_("users.view", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost { can_("users.manage", userCreate).ServeHTTP(w,r) } else { usersPage(w,r) }
 	}))
-	mux.Handle("/users/", ad(func(w http.ResponseWriter, r *http.Request) {
+	mux.Handle("/users/", p_("users.manage", func(w http.ResponseWriter, r *http.Request) {
 		switch {
-		case strings.HasSuffix(r.URL.Path,"/toggle"): userToggle(w,r)
-		case r.Method==http.MethodDelete||strings.HasSuffix(r.URL.Path,"/delete"): userDelete(w,r)
+		case strings.HasSuffix(r.URL.Path,"/toggle"):   only(post, userToggle)(w,r)
+		case strings.HasSuffix(r.URL.Path,"/edit"):     only(post, userEdit)(w,r)
+		case strings.HasSuffix(r.URL.Path,"/password"): only(post, userPassword)(w,r)
+		case strings.HasSuffix(r.URL.Path,"/roles"):    can_("roles.manage", only(post, userRoles)).ServeHTTP(w,r)
+		case strings.HasSuffix(r.URL.Path,"/sessions"): only(post, userSessions)(w,r)
+		case strings.HasSuffix(r.URL.Path,"/2fa"):      only(post, userReset2FA)(w,r)
+		case r.URL.Path == "/users/lockouts/unlock":    only(post, userUnlock)(w,r)
+		case pathSeg(r.URL.Path, 3) == "":              only(del, userDelete)(w,r)
 		default: http.NotFound(w,r)
 		}
 	}))
 
-	mux.Handle("/modules/install/github", ad(moduleInstallGitHub))
-	mux.Handle("/modules/install/zip",    ad(moduleInstallZip))
-	mux.Handle("/modules/install/",       a_(func(w http.ResponseWriter, r *http.Request) {
+	mux.Handle("/roles", p_("roles.manage", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost { roleCreate(w,r) } else { rolesPage(w,r) }
+	}))
+	mux.Handle("/roles/", p_("roles.manage", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:   roleUpdate(w,r)
+		case http.MethodDelete: roleDelete(w,r)
+		default: notAllowed(w)
+		}
+	}))
+
+	mux.Handle("/modules/install/github", p_("modules.install", only(post, moduleInstallGitHub)))
+	mux.Handle("/modules/install/zip",    p_("modules.install", only(post, moduleInstallZip)))
+	mux.Handle("/modules/install/",       p_("modules.install", func(w http.ResponseWriter, r *http.Request) {
 		if strings.HasSuffix(r.URL.Path,"/stream") { moduleInstallStream(w,r) }
 	}))
-	mux.Handle("/modules", a_(modulesPage))
+	mux.Handle("/modules", p_("modules.view", modulesPage))
 	mux.Handle("/modules/", a_(func(w http.ResponseWriter, r *http.Request) {
 		path := r.URL.Path
 		switch {
-		case strings.HasSuffix(path,"/activate"):   ad(moduleActivate).ServeHTTP(w,r)
-		case strings.HasSuffix(path,"/deactivate"): ad(moduleDeactivate).ServeHTTP(w,r)
-		case r.Method==http.MethodDelete||strings.HasSuffix(path,"/delete"): ad(moduleDelete).ServeHTTP(w,r)
-		default: moduleView(w,r)
+		case strings.HasSuffix(path,"/activate"):   can_("modules.manage", only(post, moduleActivate)).ServeHTTP(w,r)
+		case strings.HasSuffix(path,"/deactivate"): can_("modules.manage", only(post, moduleDeactivate)).ServeHTTP(w,r)
+		case strings.HasSuffix(path,"/access"):     can_("roles.manage", only(post, moduleAccess)).ServeHTTP(w,r)
+		case r.Method == http.MethodDelete:         can_("modules.manage", moduleDelete).ServeHTTP(w,r)
+		default: only(http.MethodGet, moduleView)(w,r)
 		}
 	}))
-	mux.Handle("/module-proxy/", a_(moduleProxy))
-	mux.Handle("/logs", a_(logsPage))
+	mux.Handle(modules.ProxyPrefix, a_(moduleProxy))
+	mux.Handle("/logs", p_("logs.view", logsPage))
+	mux.Handle("/audit", p_("audit.view", auditPage))
+	mux.Handle("/audit/export", p_("audit.view", auditExport))
+	mux.Handle("/password", a_(passwordPage))
+	mux.Handle("/users/change-password", a_(changePassword))
+	mux.Handle("/profile", a_(profilePage))
+	mux.Handle("/profile/tokens", a_(tokenCreate))
+	mux.Handle("/profile/tokens/", a_(tokenRevoke))
+	mux.Handle("/profile/sessions", a_(sessionRevoke))
+	mux.Handle("/profile/sessions/", a_(sessionRevoke))
+	mux.Handle("/profile/2fa/", a_(profile2FA))
+	mux.Handle("/settings/security", p_("users.manage", securitySettings))
+	mux.Handle("/backup",                p_("system.backup", only(http.MethodGet, backupPage)))
+	mux.Handle("/backup/download",       p_("system.backup", only(http.MethodGet, backupDownload)))
+	mux.Handle("/backup/restore",        p_("system.backup", only(post, backupRestore)))
+	mux.Handle("/backup/restore/cancel", p_("system.backup", only(post, backupRestoreCancel)))
 
 	return mux
 }
 
 // ── Seed ──────────────────────────────────────────────────────────────────────
 
-func seed() {
+// initialPasswordFile — файл в DATA_DIR с одноразовым паролем первого
+// администратора (только для root, 0600). hf password печатает его, смена
+// этого пароля файл удаляет. В журнал пароль не пишется.
+const initialPasswordFile = "initial-admin-password"
+
+// seed создаёт первого администратора с паролем из ADMIN_PASSWORD или
+// случайным. Пароль нужно сменить при первом входе. Возвращает
+// сгенерированный пароль, чтобы сохранить его в initialPasswordFile.
+func seed() string {
 	var n int
 	db.DB.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&n)
-	if n > 0 { return }
-	hash, _ := auth.HashPassword("admin")
-	res, _ := db.DB.Exec(
-		`INSERT INTO users (username,password,full_name,email,is_admin,is_active) VALUES ('admin',?,'Administrator','admin@hopefully.local',1,1)`,
+	if n > 0 { flagDefaultAdmin(); return "" }
+	password, generated := os.Getenv("ADMIN_PASSWORD"), ""
+	if password == "" { password = auth.RandomPassword(); generated = password }
+	hash, _ := auth.HashPassword(password)
+	res, err := db.DB.Exec(
+		`INSERT INTO users (username,password,full_name,email,is_admin,is_active,must_change_password) VALUES ('admin',?,'Administrator','admin@hopefully.local',1,1,1)`,
 		hash,
 	)
+	if err != nil { log.Fatalf("seed: %v", err) }
 	uid, _ := res.LastInsertId()
-	var roleID int64
-	db.DB.QueryRow(`SELECT id FROM roles WHERE name='admin'`).Scan(&roleID)
-	if roleID > 0 { db.DB.Exec(`INSERT OR IGNORE INTO user_roles VALUES (?,?)`,uid,roleID) }
-	log.Println("WARNING: default admin/admin created — change password immediately!")
+	auth.AssignRole(uid, "admin")
+	log.Println("seed: created admin user, password must be changed on first login")
+	return generated
+}
+
+// saveInitialPassword кладёт сгенерированный пароль в initialPasswordFile и
+// возвращает путь к нему. Если записать не удалось, возвращает сам пароль —
+// иначе его будет не узнать.
+func saveInitialPassword(password string) string {
+	path := filepath.Join(cfg.DataDir, initialPasswordFile)
+	if err := os.WriteFile(path, []byte(password+"\n"), 0600); err != nil {
+		log.Printf("seed: %v", err)
+		return password
+	}
+	return path
+}
+
+// dropInitialPassword удаляет initialPasswordFile, когда сменён записанный в
+// нём пароль: old — прежний пароль, уже проверенный при смене.
+func dropInitialPassword(old string) {
+	path := filepath.Join(cfg.DataDir, initialPasswordFile)
+	data, err := os.ReadFile(path)
+	if err != nil { return }
+	if strings.TrimSpace(string(data)) != old { return }
+	if err := os.Remove(path); err != nil { log.Printf("seed: %v", err) }
+}
+
+// flagDefaultAdmin требует сменить пароль admin, если на старой установке
+// он всё ещё стандартный admin/admin.
+func flagDefaultAdmin() {
+	var id int64
+	var hash string
+	if db.DB.QueryRow(`SELECT id,password FROM users WHERE username='admin' AND must_change_password=0`).Scan(&id,&hash) != nil { return }
+	if auth.CheckPassword(hash, "admin") {
+		db.DB.Exec(`UPDATE users SET must_change_password=1 WHERE id=?`, id)
+		log.Println("WARNING: admin still uses the default password — it must be changed on next login")
+	}
 }
 
 // ── Helpers ───────────────────────────────────────────────────────────────────
 
 func pathSeg(path string, idx int) string {
-	parts := strings.Split(strings.Trim(path,"/"),"/")
+	// Индексы считаются от ведущего "/": "/modules/x/activate" → [ "", "modules", "x", "activate" ].
+	parts := strings.Split(path,"/")
 	if idx < len(parts) { return parts[idx] }
 	return ""
 }
 
+// auditLog пишет в журнал действие текущего пользователя над target.
+func auditLog(r *http.Request, action, target string, details map[string]any) {
+	e := audit.Event{Action: action, Target: target, IP: auth.ClientIP(r), Details: details}
+	if u := auth.CtxGet(r); u != nil {
+		e.UserID, e.Actor = u.ID, u.Username
+		if u.ViaAPIToken() {
+			if e.Details == nil { e.Details = map[string]any{} }
+			e.Details["via"] = "api_token"
+		}
+	}
+	audit.Log(e)
+}
+
+// errDetails — детали события для действия, которое могло не удаться.
+func errDetails(err error) map[string]any {
+	if err == nil { return nil }
+	return map[string]any{"error": err.Error()}
+}
+
+// userTarget, roleTarget — цель события по id: "user:bob", "role:ops".
+func userTarget(id int64) string {
+	var name string
+	if db.DB.QueryRow(`SELECT username FROM users WHERE id=?`, id).Scan(&name) != nil { return fmt.Sprintf("user:#%d", id) }
+	return "user:"+name
+}
+
+func roleTarget(id int64) string {
+	role, err := auth.GetRole(id)
+	if err != nil { return fmt.Sprintf("role:#%d", id) }
+	return "role:"+role.Name
+}
+
+// only пропускает запросы с методом m (для GET — и HEAD), остальным отвечает 405.
+func only(m string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != m && !(m == http.MethodGet && r.Method == http.MethodHead) {
+			w.Header().Set("Allow", m); notAllowed(w); return
+		}
+		h(w, r)
+	}
+}
+
+func notAllowed(w http.ResponseWriter) { http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed) }
+
+// validEmail — пустой или одиночный адрес без имени ("a@b.c", не "A <a@b.c>").
+func validEmail(s string) bool {
+	if s == "" { return true }
+	a, err := mail.ParseAddress(s)
+	return err == nil && a.Address == s
+}
+
+// formIDs — числовые значения повторяющегося поля формы.
+func formIDs(r *http.Request, key string) []int64 {
+	r.ParseForm()
+	var ids []int64
+	for _, v := range r.Form[key] {
+		if id, err := strconv.ParseInt(v, 10, 64); err == nil { ids = append(ids, id) }
+	}
+	return ids
+}
+
 func tailFile(path string, n int) []string {
 	data, err := os.ReadFile(path)
 	if err != nil { return nil }
@@ -375,15 +1213,152 @@ func envOr(k, def string) string {
 	return def
 }
 
+func envInt(k string, def int) int {
+	if v := os.Getenv(k); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil { fmt.Fprintf(os.Stderr, "ERROR: %s: %v\n", k, err); os.Exit(1) }
+		return n
+	}
+	return def
+}
+
+func envBool(k string, def bool) bool {
+	if v := os.Getenv(k); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil { fmt.Fprintf(os.Stderr, "ERROR: %s: %v\n", k, err); os.Exit(1) }
+		return b
+	}
+	return def
+}
+
+func envDuration(k string, def time.Duration) time.Duration {
+	if v := os.Getenv(k); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil { fmt.Fprintf(os.Stderr, "ERROR: %s: %v\n", k, err); os.Exit(1) }
+		return d
+	}
+	return def
+}
+
+// ── Commands ──────────────────────────────────────────────────────────────────
+
+// runCommand — служебные команды: hopefully <команда> [-data DIR] [флаги].
+func runCommand(name string, args []string) int {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	dataDir := fs.String("data", envOr("DATA_DIR","/var/lib/hopefully"), "Data directory")
+	switch name {
+	case "keys":
+		fs.Parse(args)
+	case "backup":
+		out := fs.String("o", "", "Output file (default: <data>/backups/hopefully-<time>.db)")
+		fs.Parse(args)
+		dest := *out
+		if dest == "" {
+			dir := filepath.Join(*dataDir, "backups")
+			if err := os.MkdirAll(dir, 0700); err != nil { return commandError(*dataDir, err) }
+			dest = filepath.Join(dir, "hopefully-"+time.Now().Format("20060102-150405")+".db")
+		}
+		if err := db.BackupFile(*dataDir, dest); err != nil { return commandError(*dataDir, err) }
+		fmt.Printf("Backup written to %s\n", dest)
+		return 0
+	case "restore":
+		fs.Usage = func() { fmt.Fprintf(os.Stderr, "Usage: hopefully restore [-data DIR] FILE\n"); fs.PrintDefaults() }
+		fs.Parse(args)
+		if fs.NArg() != 1 { fs.Usage(); return 2 }
+		f, err := os.Open(fs.Arg(0))
+		if err != nil { return commandError(*dataDir, err) }
+		defer f.Close()
+		info, err := db.StageRestore(*dataDir, f)
+		if err != nil { return commandError(*dataDir, err) }
+		fmt.Printf("Backup accepted: schema version %d, %d users.\n", info.Version, info.Users)
+		fmt.Printf("It replaces the database on the next start (hf restart); the current one is kept as %s.before-restore-<time>.\n", db.FileName)
+		return 0
+	case "rotate-keys":
+		grace := fs.Duration("grace", 30*24*time.Hour, "How long previous keys keep verifying tokens (0 ends all sessions now)")
+		fs.Parse(args)
+		k, err := auth.RotateKeys(*dataDir, *grace)
+		if err != nil { return commandError(*dataDir, err) }
+		fmt.Printf("New signing key %s. The running server picks it up within seconds.\n\n", k.KID)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\nCommands: keys, rotate-keys, backup, restore\n", name)
+		return 2
+	}
+	kr, err := auth.LoadKeyring(*dataDir)
+	if err != nil { return commandError(*dataDir, err) }
+	fmt.Printf("%-18s %-8s %-20s %s\n", "KID", "STATUS", "CREATED", "VERIFIES UNTIL")
+	for _, k := range kr.Keys {
+		status, until := "retired", "-"
+		if k.Expires != nil { until = k.Expires.Local().Format(time.DateTime) }
+		switch {
+		case k.KID == kr.Current: status = "current"
+		case k.Active():          status = "verify"
+		}
+		fmt.Printf("%-18s %-8s %-20s %s\n", k.KID, status, k.Created.Local().Format(time.DateTime), until)
+	}
+	return 0
+}
+
+func commandError(dataDir string, err error) int {
+	if errors.Is(err, auth.ErrNoKeyring) {
+		fmt.Fprintf(os.Stderr, "ERROR: %s not found in %s — start the server once to create it\n", auth.KeysFile, dataDir)
+	} else {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+	}
+	return 1
+}
+
 // ── Main ──────────────────────────────────────────────────────────────────────
 
 func main() {
-	flag.StringVar(&cfg.Port,    "port",   envOr("PORT","8080"),                  "HTTP port")
-	flag.StringVar(&cfg.DataDir, "data",   envOr("DATA_DIR","/var/lib/hopefully"),"Data directory")
-	flag.StringVar(&cfg.Secret,  "secret", envOr("SECRET_KEY",""),                "JWT secret (required)")
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+	flag.StringVar(&cfg.Port,          "port",         envOr("PORT","8080"),                   "HTTP port")
+	flag.StringVar(&cfg.DataDir,       "data",         envOr("DATA_DIR","/var/lib/hopefully"), "Data directory")
+	flag.StringVar(&cfg.Secret,        "secret",       envOr("SECRET_KEY",""),                 "Initial signing key (required until "+auth.KeysFile+" exists in the data directory)")
+	flag.StringVar(&cfg.ModulePorts,   "module-ports", envOr("MODULE_PORTS","9200-9999"),      "Port range for modules without a fixed port")
+	flag.DurationVar(&cfg.AccessTTL,   "access-ttl",   envDuration("ACCESS_TTL",15*time.Minute),      "Access token lifetime (renewed while the session is active)")
+	flag.DurationVar(&cfg.SessionTTL,  "session-ttl",  envDuration("SESSION_TTL",24*time.Hour),       "Session lifetime without activity")
+	flag.DurationVar(&cfg.RememberTTL, "remember-ttl", envDuration("REMEMBER_TTL",30*24*time.Hour),   "Session lifetime with \"remember me\"")
+	flag.IntVar(&cfg.Password.MinLength,       "password-min-length",  envInt("PASSWORD_MIN_LENGTH",8),         "Minimum password length")
+	flag.IntVar(&cfg.Password.MinClasses,      "password-min-classes", envInt("PASSWORD_MIN_CLASSES",1),        "Character classes (lower, upper, digits, other) a password must use")
+	flag.BoolVar(&cfg.Password.RejectBreached, "password-breached",    envBool("PASSWORD_CHECK_BREACHED",true), "Reject passwords from the bundled breached-password list")
+	flag.StringVar(&cfg.LDAP.URL,            "ldap-url",           envOr("LDAP_URL",""),                             "LDAP server, ldap://host:389 or ldaps://host:636 (empty disables LDAP)")
+	flag.StringVar(&cfg.LDAP.BindDN,         "ldap-bind-dn",       envOr("LDAP_BIND_DN",""),                         "Service account DN for user lookup (empty: anonymous)")
+	flag.StringVar(&cfg.LDAP.BindPassword,   "ldap-bind-password", envOr("LDAP_BIND_PASSWORD",""),                   "Service account password")
+	flag.StringVar(&cfg.LDAP.BaseDN,         "ldap-base-dn",       envOr("LDAP_BASE_DN",""),                         "Subtree to search users in")
+	flag.StringVar(&cfg.LDAP.UserFilter,     "ldap-user-filter",   envOr("LDAP_USER_FILTER",auth.DefaultLDAPUserFilter), "User search filter, %s is the login")
+	flag.StringVar(&cfg.LDAP.UsernameAttr,   "ldap-username-attr", envOr("LDAP_USERNAME_ATTR",""),                   "Attribute with the login (empty: sAMAccountName, then uid)")
+	flag.StringVar(&cfg.LDAP.NameAttr,       "ldap-name-attr",     envOr("LDAP_NAME_ATTR","cn"),                     "Attribute with the full name")
+	flag.StringVar(&cfg.LDAP.MailAttr,       "ldap-mail-attr",     envOr("LDAP_MAIL_ATTR","mail"),                   "Attribute with the email")
+	flag.StringVar(&cfg.LDAP.GroupFilter,    "ldap-group-filter",  envOr("LDAP_GROUP_FILTER",""),                    "Group search filter, %s is the user DN (empty: use memberOf)")
+	flag.StringVar(&cfg.LDAP.GroupBaseDN,    "ldap-group-base-dn", envOr("LDAP_GROUP_BASE_DN",""),                   "Subtree to search groups in (default: base DN)")
+	flag.StringVar(&cfg.LDAPGroups,          "ldap-group-roles",   envOr("LDAP_GROUP_ROLES",""),                     "Group to role mapping: group-dn:role;group-dn:role")
+	flag.StringVar(&cfg.LDAP.DefaultRole,    "ldap-default-role",  envOr("LDAP_DEFAULT_ROLE",""),                    "Role for users in no mapped group (empty: deny login)")
+	flag.BoolVar(&cfg.LDAP.StartTLS,         "ldap-starttls",      envBool("LDAP_STARTTLS",false),                   "Upgrade ldap:// connections with StartTLS")
+	flag.BoolVar(&cfg.LDAP.InsecureSkipVerify, "ldap-insecure",    envBool("LDAP_INSECURE_SKIP_VERIFY",false),       "Do not verify the LDAP server certificate")
+	flag.DurationVar(&cfg.LDAP.Timeout,      "ldap-timeout",       envDuration("LDAP_TIMEOUT",auth.DefaultLDAPTimeout), "LDAP connect and request timeout")
+	flag.StringVar(&cfg.OIDC.Issuer,         "oidc-issuer",         envOr("OIDC_ISSUER",""),                        "OpenID Connect issuer URL (empty disables SSO)")
+	flag.StringVar(&cfg.OIDC.ClientID,       "oidc-client-id",      envOr("OIDC_CLIENT_ID",""),                     "OIDC client ID")
+	flag.StringVar(&cfg.OIDC.ClientSecret,   "oidc-client-secret",  envOr("OIDC_CLIENT_SECRET",""),                 "OIDC client secret (empty: public client with PKCE only)")
+	flag.StringVar(&cfg.OIDC.RedirectURL,    "oidc-redirect-url",   envOr("OIDC_REDIRECT_URL",""),                  "Callback URL registered at the provider (default: <portal>"+auth.OIDCCallbackPath+")")
+	flag.StringVar(&cfg.OIDCScopes,          "oidc-scopes",         envOr("OIDC_SCOPES","openid profile email"),    "Requested scopes")
+	flag.StringVar(&cfg.OIDC.UsernameClaim,  "oidc-username-claim", envOr("OIDC_USERNAME_CLAIM","preferred_username"), "ID token claim with the login")
+	flag.StringVar(&cfg.OIDC.RolesClaim,     "oidc-roles-claim",    envOr("OIDC_ROLES_CLAIM","groups"),             "ID token claim with groups or roles (dots for nested claims)")
+	flag.StringVar(&cfg.OIDCRoles,           "oidc-role-map",       envOr("OIDC_ROLE_MAP",""),                      "Claim value to role mapping: value:role;value:role")
+	flag.StringVar(&cfg.OIDC.DefaultRole,    "oidc-default-role",   envOr("OIDC_DEFAULT_ROLE",""),                  "Role for users with no mapped claim value (empty: deny login)")
+	flag.StringVar(&cfg.OIDC.Label,          "oidc-label",          envOr("OIDC_LABEL","SSO"),                      "Provider name on the login button")
+	flag.StringVar(&cfg.ProxyCIDRs,          "trusted-proxies",     envOr("TRUSTED_PROXIES",""),                    "Reverse proxies (CIDRs, comma-separated) whose X-Forwarded-* headers are trusted")
+	flag.BoolVar(&cfg.Proxy.ProxyAuth,       "proxy-auth",          envBool("PROXY_AUTH",false),                    "Log users in from trusted proxy headers instead of the login form")
+	flag.StringVar(&cfg.Proxy.UserHeader,    "proxy-user-header",   envOr("PROXY_USER_HEADER","X-Remote-User"),     "Header with the login")
+	flag.StringVar(&cfg.Proxy.GroupsHeader,  "proxy-groups-header", envOr("PROXY_GROUPS_HEADER","X-Remote-Groups"), "Header with comma-separated groups")
+	flag.StringVar(&cfg.Proxy.NameHeader,    "proxy-name-header",   envOr("PROXY_NAME_HEADER","X-Remote-Name"),     "Header with the full name")
+	flag.StringVar(&cfg.Proxy.EmailHeader,   "proxy-email-header",  envOr("PROXY_EMAIL_HEADER","X-Remote-Email"),   "Header with the email")
+	flag.StringVar(&cfg.ProxyGroups,         "proxy-group-roles",   envOr("PROXY_GROUP_ROLES",""),                  "Proxy group to role mapping: group:role;group:role")
+	flag.StringVar(&cfg.Proxy.DefaultRole,   "proxy-default-role",  envOr("PROXY_DEFAULT_ROLE",""),                 "Role for users in no mapped group (empty: deny access)")
 	flag.Parse()
 
-	if cfg.Secret == "" {
+	if _, err := os.Stat(filepath.Join(cfg.DataDir, auth.KeysFile)); cfg.Secret == "" && err != nil {
 		fmt.Fprintln(os.Stderr, "ERROR: SECRET_KEY is required\nGenerate: openssl rand -hex 32")
 		os.Exit(1)
 	}
@@ -397,23 +1372,57 @@ func main() {
 	if err == nil { log.SetOutput(lf) }
 	log.SetFlags(log.Ldate|log.Ltime|log.Lmsgprefix)
 
-	auth.Init(cfg.Secret)
-	if err := db.Init(cfg.DataDir); err != nil { log.Fatalf("db: %v", err) }
-	seed()
+	if err := auth.Init(cfg.DataDir, cfg.Secret); err != nil { log.Fatalf("keys: %v", err) }
+	auth.SetLifetimes(auth.Lifetimes{Access: cfg.AccessTTL, Session: cfg.SessionTTL, Remember: cfg.RememberTTL})
+	auth.SetPasswordPolicy(cfg.Password)
+	if cfg.LDAP.URL != "" {
+		groups, err := auth.ParseGroupRoles(cfg.LDAPGroups)
+		if err != nil { fmt.Fprintf(os.Stderr, "ERROR: ldap-group-roles: %v\n", err); os.Exit(1) }
+		cfg.LDAP.GroupRoles = groups
+		auth.SetAuthenticators(auth.NewLDAP(cfg.LDAP))
+	}
+	if cfg.OIDC.Issuer != "" {
+		if cfg.OIDC.ClientID == "" { fmt.Fprintln(os.Stderr, "ERROR: OIDC_CLIENT_ID is required with OIDC_ISSUER"); os.Exit(1) }
+		roles, err := auth.ParseGroupRoles(cfg.OIDCRoles)
+		if err != nil { fmt.Fprintf(os.Stderr, "ERROR: oidc-role-map: %v\n", err); os.Exit(1) }
+		cfg.OIDC.RoleMap, cfg.OIDC.Scopes = roles, strings.Fields(cfg.OIDCScopes)
+		auth.SetOIDC(cfg.OIDC)
+	}
+	if nets, err := auth.ParseCIDRs(cfg.ProxyCIDRs); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: trusted-proxies: %v\n", err); os.Exit(1)
+	} else if cfg.Proxy.TrustedProxies = nets; cfg.Proxy.ProxyAuth && len(nets) == 0 {
+		fmt.Fprintln(os.Stderr, "ERROR: PROXY_AUTH requires TRUSTED_PROXIES"); os.Exit(1)
+	}
+	if cfg.Proxy.GroupRoles, err = auth.ParseGroupRoles(cfg.ProxyGroups); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: proxy-group-roles: %v\n", err); os.Exit(1)
+	}
+	auth.SetProxy(cfg.Proxy)
+	if err := db.Init(cfg.DataDir); err != nil {
+		// Отказ из-за схемы (база новее бинарника, изменённая миграция) должен быть виден сразу
+		log.Printf("db: %v", err); fmt.Fprintf(os.Stderr, "ERROR: db: %v\n", err); os.Exit(1)
+	}
+	adminPassword := seed()
 	modules.Default.Setup(cfg.DataDir)
+	if lo, hi, err := modules.ParsePortRange(cfg.ModulePorts); err != nil {
+		log.Fatalf("module-ports: %v", err)
+	} else {
+		modules.Default.SetPortRange(lo, hi)
+	}
 	modules.Default.LoadFromDB()
 	initTemplates()
 
 	srv := &http.Server{
 		Addr:         ":"+cfg.Port,
-		Handler:      newRouter(),
+		Handler:      auth.CSRF(newRouter(), modules.ProxyPrefix),
 		ReadTimeout:  15*time.Second,
 		WriteTimeout: 0,
 		IdleTimeout:  120*time.Second,
 	}
 
 	go func() {
-		fmt.Printf("\n  Hopefully v%s\n  http://localhost:%s\n  admin / admin\n\n", version, cfg.Port)
+		fmt.Printf("\n  Hopefully v%s\n  http://localhost:%s\n", version, cfg.Port)
+		if adminPassword != "" { fmt.Printf("  admin password: %s  (one-time, change on first login)\n", saveInitialPassword(adminPassword)) }
+		fmt.Println()
 		if err := srv.ListenAndServe(); err != http.ErrServerClosed { log.Fatalf("http: %v", err) }
 	}()
 
@@ -423,5 +1432,6 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	srv.Shutdown(ctx)
+	modules.Default.StopAll()
 	log.Println("stopped")
 }
@@ -187,7 +187,7 @@ EnvironmentFile=${DATA_DIR}/.env
 ExecStart=${BIN} -port \${PORT} -data \${DATA_DIR} -secret \${SECRET_KEY}
 Restart=on-failure
 RestartSec=5s
-TimeoutStopSec=15s
+TimeoutStopSec=30s
 
 # Логи пишутся самим приложением в DATA_DIR/logs/
 # Для просмотра через journalctl:
@@ -266,6 +266,25 @@ case "${1:-help}" in
       exit 1
     fi
     ;;
+  keys)
+    /usr/local/bin/hopefully keys -data /var/lib/hopefully ;;
+  rotate-keys)
+    shift
+    /usr/local/bin/hopefully rotate-keys -data /var/lib/hopefully "$@" ;;
+  backup)
+    shift
+    /usr/local/bin/hopefully backup -data /var/lib/hopefully "$@" ;;
+  restore)
+    shift
+    /usr/local/bin/hopefully restore -data /var/lib/hopefully "$@" ;;
+  password)
+    if [[ -r /var/lib/hopefully/initial-admin-password ]]; then
+      cat /var/lib/hopefully/initial-admin-password
+    elif [[ -e /var/lib/hopefully/initial-admin-password ]]; then
+      echo "Нужны права root: sudo hf password"; exit 1
+    else
+      echo "Начальный пароль admin уже сменён"; exit 1
+    fi ;;
   version)
     /usr/local/bin/hopefully -version 2>/dev/null || echo "Hopefully (version unknown)" ;;
   help|*)
@@ -281,6 +300,14 @@ case "${1:-help}" in
     echo "    status   — статус сервиса"
     echo "    logs     — логи в реальном времени"
     echo "    update   — обновить до последней версии"
+    echo "    keys     — ключи подписи сессий"
+    echo "    rotate-keys [-grace 720h] — новый ключ подписи; старые"
+    echo "             действуют ещё grace (0 — завершить все сеансы)"
+    echo "    backup [-o файл] — снимок базы (по умолчанию в"
+    echo "             /var/lib/hopefully/backups)"
+    echo "    restore <файл> — восстановить базу из копии при"
+    echo "             следующем запуске (hf restart)"
+    echo "    password — одноразовый пароль admin (до его смены)"
     echo "    version  — версия"
     echo ""
     ;;
@@ -300,8 +327,16 @@ echo -e "${BOLD}${GREEN}║   🌱 Hopefully успешно установлен
 echo -e "${BOLD}${GREEN}╚══════════════════════════════════════════════╝${NC}"
 echo ""
 echo -e "  ${BOLD}Веб-интерфейс:${NC}  ${CYAN}${URL}${NC}"
+# Пароль admin генерируется при первом запуске и сохраняется в файл только
+# для root; смена пароля файл удаляет
+ADMIN_PW_FILE="${DATA_DIR}/initial-admin-password"
+for i in $(seq 1 5); do [[ -f "$ADMIN_PW_FILE" ]] && break; sleep 1; done
 echo -e "  ${BOLD}Логин:${NC}          admin"
-echo -e "  ${BOLD}Пароль:${NC}         admin  ${RED}← СМЕНИТЕ НЕМЕДЛЕННО!${NC}"
+if [[ -f "$ADMIN_PW_FILE" ]]; then
+  echo -e "  ${BOLD}Пароль:${NC}         $(cat "$ADMIN_PW_FILE")  ${RED}← одноразовый, смените при входе${NC}"
+else
+  echo -e "  ${BOLD}Пароль:${NC}         sudo hf password"
+fi
 echo ""
 echo -e "  ${BOLD}Управление:${NC}"
 echo -e "    ${CYAN}hf start${NC}    — запустить"
@@ -0,0 +1,182 @@
+// Package audit — журнал действий пользователей: кто, что, над чем, откуда и когда.
+package audit
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/ZenithSolitude/Hopefully/internal/db"
+)
+
+// Event — запись журнала. Actor — логин на момент действия: запись
+// остаётся читаемой и после удаления или переименования пользователя.
+type Event struct {
+	ID      int64          `json:"id"`
+	Time    string         `json:"time"`
+	UserID  int64          `json:"user_id,omitempty"`
+	Actor   string         `json:"actor"`
+	Action  string         `json:"action"`
+	Target  string         `json:"target,omitempty"`
+	IP      string         `json:"ip,omitempty"`
+	Details map[string]any `json:"details,omitempty"`
+}
+
+// Log пишет событие. Ошибка записи не должна ломать само действие —
+// она только попадает в лог сервера.
+func Log(e Event) {
+	if e.Actor == "" && e.UserID != 0 {
+		db.DB.QueryRow(`SELECT username FROM users WHERE id = ?`, e.UserID).Scan(&e.Actor)
+	}
+	details := "{}"
+	if len(e.Details) > 0 {
+		if b, err := json.Marshal(e.Details); err == nil {
+			details = string(b)
+		}
+	}
+	var uid any
+	if e.UserID != 0 {
+		uid = e.UserID
+	}
+	if _, err := db.DB.Exec(
+		`INSERT INTO audit_events (user_id, actor, action, target, ip, details) VALUES (?, ?, ?, ?, ?, ?)`,
+		uid, e.Actor, e.Action, e.Target, e.IP, details); err != nil {
+		log.Printf("audit: %s: %v", e.Action, err)
+	}
+}
+
+// Filter — условия выборки. Action с точкой на конце ("user.") — префикс.
+// From и To — даты YYYY-MM-DD включительно.
+type Filter struct {
+	Actor  string
+	Action string
+	Target string
+	From   string
+	To     string
+}
+
+func (f Filter) where() (string, []any) {
+	var conds []string
+	var args []any
+	if f.Actor != "" {
+		conds, args = append(conds, "actor = ?"), append(args, f.Actor)
+	}
+	if strings.HasSuffix(f.Action, ".") {
+		conds, args = append(conds, "substr(action, 1, ?) = ?"), append(args, len(f.Action), f.Action)
+	} else if f.Action != "" {
+		conds, args = append(conds, "action = ?"), append(args, f.Action)
+	}
+	if f.Target != "" {
+		conds, args = append(conds, "instr(target, ?) > 0"), append(args, f.Target)
+	}
+	if _, err := time.Parse(time.DateOnly, f.From); err == nil {
+		conds, args = append(conds, "created_at >= ?"), append(args, f.From)
+	}
+	if t, err := time.Parse(time.DateOnly, f.To); err == nil {
+		conds, args = append(conds, "created_at < ?"), append(args, t.AddDate(0, 0, 1).Format(time.DateOnly))
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// Query — страница событий (новые сначала) и общее число подходящих.
+func Query(f Filter, limit, offset int) ([]Event, int, error) {
+	where, args := f.where()
+	var total int
+	if err := db.DB.QueryRow(`SELECT COUNT(*) FROM audit_events`+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	var out []Event
+	err := each(where+` ORDER BY id DESC LIMIT ? OFFSET ?`, append(args, limit, offset), func(e Event) error {
+		out = append(out, e)
+		return nil
+	})
+	return out, total, err
+}
+
+// eachBatch — сколько событий Each читает за один запрос.
+const eachBatch = 500
+
+// Each обходит все подходящие события (новые сначала) — для выгрузки.
+// События читаются пачками по id, и fn вызывается, когда курсор уже закрыт:
+// соединение с БД одно, и медленный получатель выгрузки не должен его держать.
+func Each(f Filter, fn func(Event) error) error {
+	where, args := f.where()
+	if where == "" {
+		where = " WHERE "
+	} else {
+		where += " AND "
+	}
+	before := int64(math.MaxInt64)
+	for {
+		var batch []Event
+		err := each(where+`id < ? ORDER BY id DESC LIMIT ?`, append(args[:len(args):len(args)], before, eachBatch), func(e Event) error {
+			batch = append(batch, e)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, e := range batch {
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		if len(batch) < eachBatch {
+			return nil
+		}
+		before = batch[len(batch)-1].ID
+	}
+}
+
+func each(tail string, args []any, fn func(Event) error) error {
+	rows, err := db.DB.Query(
+		`SELECT id, created_at, COALESCE(user_id, 0), actor, action, target, ip, details FROM audit_events`+tail, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e Event
+		var details string
+		if err := rows.Scan(&e.ID, &e.Time, &e.UserID, &e.Actor, &e.Action, &e.Target, &e.IP, &details); err != nil {
+			return err
+		}
+		json.Unmarshal([]byte(details), &e.Details)
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Actions — встречающиеся в журнале действия, для фильтра на странице.
+func Actions() ([]string, error) {
+	rows, err := db.DB.Query(`SELECT DISTINCT action FROM audit_events ORDER BY action`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var a string
+		if err := rows.Scan(&a); err != nil {
+			return nil, err
+		}
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// DetailsText — детали как JSON одной строкой, для таблицы на странице.
+func (e Event) DetailsText() string {
+	if len(e.Details) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(e.Details)
+	return string(b)
+}
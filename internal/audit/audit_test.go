@@ -0,0 +1,80 @@
+package audit
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ZenithSolitude/Hopefully/internal/db"
+)
+
+func setupDB(t *testing.T) {
+	t.Helper()
+	if err := db.Init(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.DB.Close() })
+}
+
+func TestEach(t *testing.T) {
+	setupDB(t)
+	n := 2*eachBatch + 7
+	for i := 1; i <= n; i++ {
+		action := "user.update"
+		if i%3 == 0 {
+			action = "auth.login"
+		}
+		Log(Event{Actor: "root", Action: action, Target: fmt.Sprintf("user:%d", i)})
+	}
+
+	tests := []struct {
+		name string
+		f    Filter
+		want int
+	}{
+		{"all", Filter{}, n},
+		{"prefix", Filter{Action: "user."}, n - n/3},
+		{"exact", Filter{Action: "auth.login"}, n / 3},
+		{"target", Filter{Target: "user:1007"}, 1},
+		{"none", Filter{Actor: "nobody"}, 0},
+	}
+	for _, tt := range tests {
+		var got int
+		last := int64(1 << 62)
+		err := Each(tt.f, func(e Event) error {
+			if e.ID >= last {
+				return fmt.Errorf("event %d after %d", e.ID, last)
+			}
+			last = e.ID
+			got++
+			return nil
+		})
+		if err != nil || got != tt.want {
+			t.Errorf("%s: %d events, %v; want %d", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+// Пока выгрузка пишет клиенту, курсор закрыт: другие запросы к базе, у
+// которой одно соединение, не ждут медленного получателя.
+func TestEachReleasesConnection(t *testing.T) {
+	setupDB(t)
+	for i := 0; i < eachBatch+1; i++ {
+		Log(Event{Actor: "root", Action: "user.update"})
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- Each(Filter{}, func(Event) error {
+			var one int
+			return db.DB.QueryRow(`SELECT 1`).Scan(&one)
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Each holds the database connection while calling fn")
+	}
+}
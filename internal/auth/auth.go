@@ -2,8 +2,8 @@ package auth
 
 import (
 	"context"
+	"crypto/rand"
 	"errors"
-	"fmt"
 	"net/http"
 	"strings"
 	"time"
@@ -16,9 +16,26 @@ import (
 
 // ── Config ────────────────────────────────────────────────────────────────────
 
-var secret []byte
+// Init загружает ключи подписи из каталога данных (при первом запуске
+// создаёт их из secret, см. keyring.go).
+func Init(dataDir, secret string) error {
+	go dummyHash() // заранее, чтобы первый вход с неизвестным логином не был заметно дольше
+	return initKeys(dataDir, secret)
+}
+
+// Lifetimes — сроки жизни токена доступа (JWT в cookie) и сессии за ним.
+// Токен короткий и продлевается Middleware, пока сессия жива; сессия
+// сдвигается при каждом продлении — истекает после Session (или Remember)
+// без активности.
+type Lifetimes struct {
+	Access   time.Duration
+	Session  time.Duration
+	Remember time.Duration // сессия с «Запомнить меня»
+}
 
-func Init(key string) { secret = []byte(key) }
+var lifetimes = Lifetimes{Access: 15 * time.Minute, Session: 24 * time.Hour, Remember: 30 * 24 * time.Hour}
+
+func SetLifetimes(l Lifetimes) { lifetimes = l }
 
 // ── User ──────────────────────────────────────────────────────────────────────
 
@@ -31,8 +48,28 @@ type User struct {
 	IsActive  bool
 	CreatedAt string
 	LastLogin string
+
+	TOTPEnabled        bool
+	MustChangePassword bool
+	AuthSource         string // SourceLocal или имя внешнего источника
+
+	Roles       []string
+	Permissions []string // права всех ролей, заполняются в Middleware
+
+	scopes  []string // при входе по API-токену — его scopes, иначе nil
+	session string   // id сессии при входе по cookie
+	proxied bool     // аутентифицирован доверенным прокси
 }
 
+// ViaAPIToken — пришёл ли запрос с личным API-токеном.
+func (u *User) ViaAPIToken() bool { return u.scopes != nil }
+
+// ViaProxy — пользователя аутентифицировал прокси: выйти можно только на нём.
+func (u *User) ViaProxy() bool { return u.proxied }
+
+// SessionID — id текущей сессии ("" при входе по API-токену).
+func (u *User) SessionID() string { return u.session }
+
 func (u *User) DisplayName() string {
 	if u.FullName != "" {
 		return u.FullName
@@ -51,6 +88,64 @@ func CheckPassword(hash, plain string) bool {
 	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(plain)) == nil
 }
 
+// RandomPassword — одноразовый пароль для выдачи пользователю (сменить при входе).
+func RandomPassword() string {
+	const alphabet = "abcdefghijkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	limit := 256 - 256%len(alphabet) // отбрасываем байты, дающие перекос в пользу начала алфавита
+	out := make([]byte, 0, 16)
+	buf := make([]byte, 32)
+	for len(out) < cap(out) {
+		rand.Read(buf)
+		for _, c := range buf {
+			if int(c) < limit && len(out) < cap(out) {
+				out = append(out, alphabet[int(c)%len(alphabet)])
+			}
+		}
+	}
+	return string(out)
+}
+
+var ErrSamePassword = errors.New("new password must differ from the old one")
+
+// ChangePassword меняет пароль пользователя, проверив старый, и снимает
+// требование сменить пароль.
+func ChangePassword(uid int64, oldPassword, newPassword string) error {
+	var hash, source string
+	if err := db.DB.QueryRow(`SELECT password, auth_source FROM users WHERE id = ?`, uid).Scan(&hash, &source); err != nil {
+		return err
+	}
+	if source != SourceLocal {
+		return ErrExternalAccount
+	}
+	if !CheckPassword(hash, oldPassword) {
+		return ErrBadCredentials
+	}
+	if oldPassword == newPassword {
+		return ErrSamePassword
+	}
+	if err := ValidatePassword(newPassword); err != nil {
+		return err
+	}
+	return SetPassword(uid, newPassword, false)
+}
+
+// UpdateProfile меняет имя и email пользователя.
+func UpdateProfile(uid int64, fullName, email string) error {
+	_, err := db.DB.Exec(`UPDATE users SET full_name = ?, email = ? WHERE id = ?`, fullName, email, uid)
+	return err
+}
+
+// SetPassword задаёт пароль без проверки старого; mustChange — потребовать
+// сменить его при следующем входе (пароль выдан администратором).
+func SetPassword(uid int64, password string, mustChange bool) error {
+	h, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = db.DB.Exec(`UPDATE users SET password = ?, must_change_password = ? WHERE id = ?`, h, mustChange, uid)
+	return err
+}
+
 // ── JWT ───────────────────────────────────────────────────────────────────────
 
 type claims struct {
@@ -58,32 +153,48 @@ type claims struct {
 	jwt.RegisteredClaims
 }
 
-func NewToken(userID int64, dur time.Duration) (string, error) {
+func NewToken(userID int64, sid string, dur time.Duration) (string, error) {
 	c := claims{
 		UID: userID,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        sid,
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(dur)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
-	return jwt.NewWithClaims(jwt.SigningMethodHS256, c).SignedString(secret)
+	return sign(c)
 }
 
-func ParseToken(s string) (int64, error) {
-	tok, err := jwt.ParseWithClaims(s, &claims{}, func(t *jwt.Token) (any, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected method")
-		}
-		return secret, nil
-	})
+// ParseToken возвращает id пользователя и id сессии (jti).
+func ParseToken(s string) (int64, string, error) {
+	c, err := parseAccess(s)
+	if err != nil {
+		return 0, "", err
+	}
+	return c.UID, c.ID, nil
+}
+
+// parseAccess проверяет подпись и срок токена доступа.
+func parseAccess(s string) (*claims, error) {
+	return parseClaims(s, jwt.WithExpirationRequired())
+}
+
+// parseSigned проверяет подпись, но не срок: истёкший токен годится только
+// чтобы продлить живую сессию или завершить её при выходе.
+func parseSigned(s string) (*claims, error) {
+	return parseClaims(s, jwt.WithoutClaimsValidation())
+}
+
+func parseClaims(s string, opts ...jwt.ParserOption) (*claims, error) {
+	tok, err := jwt.ParseWithClaims(s, &claims{}, verifyKey, opts...)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 	c, ok := tok.Claims.(*claims)
-	if !ok || !tok.Valid {
-		return 0, errors.New("invalid token")
+	if !ok || !tok.Valid || c.ID == "" {
+		return nil, errors.New("invalid token")
 	}
-	return c.UID, nil
+	return c, nil
 }
 
 // ── DB helpers ────────────────────────────────────────────────────────────────
@@ -91,9 +202,9 @@ func ParseToken(s string) (int64, error) {
 func GetByID(id int64) (*User, error) {
 	u := &User{}
 	err := db.DB.QueryRow(
-		`SELECT id, username, full_name, email, is_admin, is_active, created_at, COALESCE(last_login,'')
+		`SELECT id, username, full_name, email, is_admin, is_active, created_at, COALESCE(last_login,''), totp_enabled, must_change_password, auth_source
 		 FROM users WHERE id = ?`, id,
-	).Scan(&u.ID, &u.Username, &u.FullName, &u.Email, &u.IsAdmin, &u.IsActive, &u.CreatedAt, &u.LastLogin)
+	).Scan(&u.ID, &u.Username, &u.FullName, &u.Email, &u.IsAdmin, &u.IsActive, &u.CreatedAt, &u.LastLogin, &u.TOTPEnabled, &u.MustChangePassword, &u.AuthSource)
 	return u, err
 }
 
@@ -101,9 +212,9 @@ func GetByUsername(username string) (*User, string, error) {
 	u := &User{}
 	var hash string
 	err := db.DB.QueryRow(
-		`SELECT id, username, full_name, email, is_admin, is_active, created_at, COALESCE(last_login,''), password
+		`SELECT id, username, full_name, email, is_admin, is_active, created_at, COALESCE(last_login,''), totp_enabled, must_change_password, auth_source, password
 		 FROM users WHERE username = ?`, username,
-	).Scan(&u.ID, &u.Username, &u.FullName, &u.Email, &u.IsAdmin, &u.IsActive, &u.CreatedAt, &u.LastLogin, &hash)
+	).Scan(&u.ID, &u.Username, &u.FullName, &u.Email, &u.IsAdmin, &u.IsActive, &u.CreatedAt, &u.LastLogin, &u.TOTPEnabled, &u.MustChangePassword, &u.AuthSource, &hash)
 	return u, hash, err
 }
 
@@ -125,44 +236,132 @@ func CtxGet(r *http.Request) *User {
 func Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		tok := cookieToken(r)
+		if strings.HasPrefix(tok, APITokenPrefix) {
+			apiTokenAuth(w, r, tok, next)
+			return
+		}
+		if name := proxyIdentity(r); name != "" {
+			proxyAuth(w, r, name, next)
+			return
+		}
 		if tok == "" {
 			redirect(w, r)
 			return
 		}
-		uid, err := ParseToken(tok)
+		c, err := parseAccess(tok)
+		expired := errors.Is(err, jwt.ErrTokenExpired)
+		if expired {
+			// Истёкший токен принимается только для продления: ниже он
+			// сразу заменяется новым, если сессия ещё жива.
+			c, err = parseSigned(tok)
+		}
+		var remember bool
+		if err == nil {
+			remember, err = checkSession(c.ID, c.UID)
+		}
 		if err != nil {
 			clearCookie(w)
 			redirect(w, r)
 			return
 		}
+		uid, sid := c.UID, c.ID
+		// Токен истёк или скоро истечёт, а сессия жива — выдаём новый.
+		if expired || time.Until(c.ExpiresAt.Time) < lifetimes.Access/2 {
+			if err := renewSession(w, uid, sid, remember); err != nil {
+				http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+		}
 		u, err := GetByID(uid)
 		if err != nil || !u.IsActive {
 			clearCookie(w)
 			redirect(w, r)
 			return
 		}
+		u.session = sid
+		if err := loadRoles(u); err != nil {
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		// Пока не сменён временный пароль или не включена обязательная 2FA,
+		// открыты только страницы, где это делается.
+		if to := pendingSetup(u); to != "" && !setupPath(r.URL.Path) {
+			redirectTo(w, r, to)
+			return
+		}
 		next.ServeHTTP(w, CtxSet(r, u))
 	})
 }
 
-func AdminOnly(next http.Handler) http.Handler {
-	return Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !CtxGet(r).IsAdmin {
-			http.Error(w, "403 Forbidden", http.StatusForbidden)
-			return
-		}
-		next.ServeHTTP(w, r)
-	}))
+// pendingSetup — куда отправить пользователя, которому нужно закончить настройку аккаунта.
+func pendingSetup(u *User) string {
+	switch {
+	case u.MustChangePassword:
+		return "/password"
+	case TwoFactorRequired(u):
+		return "/profile"
+	}
+	return ""
+}
+
+// setupPath — страницы, доступные до завершения обязательной настройки аккаунта.
+func setupPath(p string) bool {
+	switch p {
+	case "/password", "/users/change-password", "/profile", "/logout":
+		return true
+	}
+	return strings.HasPrefix(p, "/profile/2fa/")
 }
 
-func SetCookie(w http.ResponseWriter, tok string) {
+// apiTokenAuth — вход по личному токену: без cookie и редиректов, ошибки — 401.
+func apiTokenAuth(w http.ResponseWriter, r *http.Request, tok string, next http.Handler) {
+	uid, scopes, err := lookupAPIToken(tok)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	u, err := GetByID(uid)
+	if err != nil || !u.IsActive {
+		http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err := loadRoles(u); err != nil {
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	u.scopes = scopes
+	next.ServeHTTP(w, CtxSet(r, u))
+}
+
+// proxyAuth — вход по заголовкам доверенного прокси: без cookie и сессии,
+// каждый запрос. Второй фактор и прочие требования ко входу — забота прокси.
+func proxyAuth(w http.ResponseWriter, r *http.Request, username string, next http.Handler) {
+	u, err := proxyUser(r, username)
+	if errors.Is(err, ErrBadCredentials) || (err == nil && !u.IsActive) {
+		http.Error(w, "403 Forbidden: this account may not use the portal", http.StatusForbidden)
+		return
+	}
+	if err == nil {
+		err = loadRoles(u)
+	}
+	if err != nil {
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	u.proxied = true
+	next.ServeHTTP(w, CtxSet(r, u))
+}
+
+// SetCookie ставит cookie сессии; maxAge = 0 — cookie живёт до закрытия браузера.
+func SetCookie(w http.ResponseWriter, tok string, maxAge time.Duration) {
 	http.SetCookie(w, &http.Cookie{
 		Name:     "tok",
 		Value:    tok,
 		Path:     "/",
 		HttpOnly: true,
 		SameSite: http.SameSiteLaxMode,
-		MaxAge:   int((24 * time.Hour).Seconds()),
+		MaxAge:   int(maxAge.Seconds()),
 	})
 }
 
@@ -180,6 +379,30 @@ func cookieToken(r *http.Request) string {
 	return ""
 }
 
+// StripCredentials убирает из запроса cookie сессии и CSRF и Bearer-токен портала,
+// чтобы они не ушли дальше (например, в модуль через прокси).
+func StripCredentials(r *http.Request) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != "tok" && c.Name != csrfCookie {
+			r.AddCookie(c)
+		}
+	}
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		if _, err := parseSigned(h[7:]); err == nil || strings.HasPrefix(h[7:], APITokenPrefix) {
+			r.Header.Del("Authorization")
+		}
+	}
+	if proxy.ProxyAuth {
+		for _, h := range []string{proxy.UserHeader, proxy.GroupsHeader, proxy.NameHeader, proxy.EmailHeader} {
+			if h != "" {
+				r.Header.Del(h)
+			}
+		}
+	}
+}
+
 func redirect(w http.ResponseWriter, r *http.Request) {
 	if r.Header.Get("HX-Request") == "true" {
 		w.Header().Set("HX-Redirect", "/login")
@@ -188,3 +411,12 @@ func redirect(w http.ResponseWriter, r *http.Request) {
 	}
 	http.Redirect(w, r, "/login", http.StatusFound)
 }
+
+func redirectTo(w http.ResponseWriter, r *http.Request, path string) {
+	if r.Header.Get("HX-Request") == "true" {
+		w.Header().Set("HX-Redirect", path)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	http.Redirect(w, r, path, http.StatusFound)
+}
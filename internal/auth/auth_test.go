@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ZenithSolitude/Hopefully/internal/db"
+)
+
+// setupDB открывает чистую базу и связку ключей во временном каталоге.
+func setupDB(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := db.Init(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.DB.Close() })
+	if err := initKeys(dir, "test-secret"); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// addUser заводит локального пользователя с ролями по именам.
+func addUser(t *testing.T, username string, roles ...string) *User {
+	t.Helper()
+	ids, err := roleIDsByName(roles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid, err := CreateUser(username, "Correct-Horse-42", "", "", ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := GetByID(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loadRoles(u); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// login открывает сессию пользователю и возвращает её id.
+func login(t *testing.T, u *User) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	if err := StartSession(rec, httptest.NewRequest(http.MethodPost, "/login", nil), u.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	_, sid, err := ParseToken(rec.Result().Cookies()[0].Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sid
+}
+
+func TestMiddlewareTokenExpiry(t *testing.T) {
+	setupDB(t)
+	u := addUser(t, "bob", UserRole)
+	sid := login(t, u)
+	token := func(ttl time.Duration) string {
+		tok, err := NewToken(u.ID, sid, ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok
+	}
+
+	tests := []struct {
+		name    string
+		tok     string
+		revoke  bool
+		pass    bool
+		renewed bool
+	}{
+		{"fresh", token(lifetimes.Access), false, true, false},
+		{"near expiry", token(time.Minute), false, true, true},
+		{"expired, session alive", token(-time.Minute), false, true, true},
+		{"expired, session revoked", token(-time.Minute), true, false, false},
+		{"fresh, session revoked", token(lifetimes.Access), true, false, false},
+		{"garbage", "not-a-jwt", false, false, false},
+	}
+	for _, tt := range tests {
+		if tt.revoke {
+			RevokeUserSessions(u.ID, "")
+		}
+		passed := false
+		h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { passed = true }))
+		req := httptest.NewRequest(http.MethodGet, "/dashboard", nil)
+		req.AddCookie(&http.Cookie{Name: "tok", Value: tt.tok})
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if passed != tt.pass {
+			t.Errorf("%s: passed = %v, want %v (status %d)", tt.name, passed, tt.pass, rec.Code)
+		}
+		renewed := false
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == "tok" && c.Value != "" {
+				_, _, err := ParseToken(c.Value)
+				renewed = err == nil
+			}
+		}
+		if renewed != tt.renewed {
+			t.Errorf("%s: renewed = %v, want %v", tt.name, renewed, tt.renewed)
+		}
+		if tt.revoke {
+			sid = login(t, u)
+		}
+	}
+}
+
+// RequirePermission не аутентифицирует сама: без Middleware пользователя нет.
+func TestRequirePermissionNeedsMiddleware(t *testing.T) {
+	setupDB(t)
+	u := addUser(t, "bob", UserRole)
+	tok, err := NewToken(u.ID, login(t, u), lifetimes.Access)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		name string
+		h    http.Handler
+		code int
+	}{
+		{"without middleware", RequirePermission("dashboard.view")(ok), http.StatusForbidden},
+		{"granted", Middleware(RequirePermission("dashboard.view")(ok)), http.StatusOK},
+		{"denied", Middleware(RequirePermission("users.manage")(ok)), http.StatusForbidden},
+		{"nested", Middleware(RequirePermission("dashboard.view")(RequirePermission("modules.view")(ok))), http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(&http.Cookie{Name: "tok", Value: tok})
+		rec := httptest.NewRecorder()
+		tt.h.ServeHTTP(rec, req)
+		if rec.Code != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.code)
+		}
+	}
+}
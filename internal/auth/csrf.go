@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ── CSRF ──────────────────────────────────────────────────────────────────────
+
+// Защита по схеме double-submit: случайный токен лежит в cookie csrf и
+// вписывается сервером в страницу (hx-headers в base.html, скрытое поле в
+// формах входа). Изменяющий запрос должен вернуть его в заголовке
+// X-CSRF-Token или поле csrf_token; чужой сайт cookie прочитать не может.
+// Дополнительно Origin (или Referer) изменяющего запроса должен совпадать
+// с хостом портала.
+
+const (
+	csrfCookie = "csrf"
+	CSRFHeader = "X-CSRF-Token"
+	CSRFField  = "csrf_token"
+)
+
+type csrfKey struct{}
+
+// CSRF проверяет изменяющие запросы (всё, кроме GET, HEAD, OPTIONS).
+// Пути с префиксами skipToken проверяются только по Origin/Referer: это
+// прокси модулей, формы которых о токене портала не знают.
+func CSRF(next http.Handler, skipToken ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tok := csrfToken(r)
+		if tok == "" {
+			tok = newCSRFToken()
+			http.SetCookie(w, &http.Cookie{
+				Name:     csrfCookie,
+				Value:    tok,
+				Path:     "/",
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+				Secure:   RequestScheme(r) == "https",
+			})
+		}
+		r = r.WithContext(context.WithValue(r.Context(), csrfKey{}, tok))
+		if safeMethod(r.Method) || bearerOnly(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !sameOrigin(r) {
+			http.Error(w, "403 Forbidden: cross-origin request", http.StatusForbidden)
+			return
+		}
+		for _, p := range skipToken {
+			if strings.HasPrefix(r.URL.Path, p) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		sent := r.Header.Get(CSRFHeader)
+		if sent == "" {
+			sent = r.FormValue(CSRFField)
+		}
+		if sent == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(csrfToken(r))) != 1 {
+			http.Error(w, "403 Forbidden: missing or invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// CSRFToken — токен текущего запроса для вставки в страницу.
+func CSRFToken(r *http.Request) string {
+	tok, _ := r.Context().Value(csrfKey{}).(string)
+	return tok
+}
+
+func csrfToken(r *http.Request) string {
+	if c, err := r.Cookie(csrfCookie); err == nil && len(c.Value) == 64 {
+		return c.Value
+	}
+	return ""
+}
+
+func newCSRFToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func safeMethod(m string) bool {
+	return m == http.MethodGet || m == http.MethodHead || m == http.MethodOptions
+}
+
+// bearerOnly — запрос аутентифицирован только заголовком Authorization, без
+// cookie сессии: действующим личным токеном или JWT портала. Такой заголовок
+// чужой сайт подставить не может, и скриптам с API-токеном CSRF-токен не
+// нужен. Произвольное значение Bearer проверку не отключает, как и любой
+// запрос с заголовками прокси-входа: прокси сам может подставлять
+// Authorization в запросы браузера.
+func bearerOnly(r *http.Request) bool {
+	if _, err := r.Cookie("tok"); err == nil {
+		return false
+	}
+	if proxyIdentity(r) != "" {
+		return false
+	}
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return false
+	}
+	tok := h[7:]
+	if strings.HasPrefix(tok, APITokenPrefix) {
+		_, _, err := lookupAPIToken(tok)
+		return err == nil
+	}
+	_, err := parseAccess(tok)
+	return err == nil
+}
+
+// sameOrigin сверяет Origin, а без него Referer, с хостом запроса (за
+// доверенным прокси — с X-Forwarded-Host). Если нет
+// ни того, ни другого (не браузер), решает токен.
+func sameOrigin(r *http.Request) bool {
+	src := r.Header.Get("Origin")
+	if src == "" {
+		src = r.Header.Get("Referer")
+	}
+	if src == "" {
+		return true
+	}
+	u, err := url.Parse(src)
+	if err != nil || u.Host == "" {
+		return false // в том числе Origin: null
+	}
+	return strings.EqualFold(u.Host, RequestHost(r))
+}
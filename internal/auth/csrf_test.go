@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRF(t *testing.T) {
+	setupDB(t)
+	bob := addUser(t, "bob", UserRole)
+	apiTok, err := CreateAPIToken(bob, "ci", []string{"modules.view"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwtTok, err := NewToken(bob.ID, login(t, bob), lifetimes.Access)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := strings.Repeat("ab", 32)
+	h := CSRF(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), "/module-proxy/")
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		header  map[string]string
+		form    url.Values
+		cookies []string // имена cookie: csrf получает значение cookie, остальные — "x"
+		code    int
+	}{
+		{"GET without token", http.MethodGet, "/", nil, nil, nil, http.StatusOK},
+		{"POST without token", http.MethodPost, "/", nil, nil, []string{"csrf"}, http.StatusForbidden},
+		{"POST without cookie", http.MethodPost, "/", map[string]string{CSRFHeader: cookie}, nil, nil, http.StatusForbidden},
+		{"header token", http.MethodPost, "/", map[string]string{CSRFHeader: cookie}, nil, []string{"csrf"}, http.StatusOK},
+		{"wrong header token", http.MethodPost, "/", map[string]string{CSRFHeader: strings.Repeat("cd", 32)}, nil, []string{"csrf"}, http.StatusForbidden},
+		{"form token", http.MethodPost, "/", nil, url.Values{CSRFField: {cookie}}, []string{"csrf"}, http.StatusOK},
+		{"DELETE without token", http.MethodDelete, "/users/1", nil, nil, []string{"csrf"}, http.StatusForbidden},
+		{"cross-site Origin", http.MethodPost, "/", map[string]string{CSRFHeader: cookie, "Origin": "https://evil.test"}, nil, []string{"csrf"}, http.StatusForbidden},
+		{"Origin null", http.MethodPost, "/", map[string]string{CSRFHeader: cookie, "Origin": "null"}, nil, []string{"csrf"}, http.StatusForbidden},
+		{"same-host Origin", http.MethodPost, "/", map[string]string{CSRFHeader: cookie, "Origin": "http://example.com"}, nil, []string{"csrf"}, http.StatusOK},
+		{"same-host Referer", http.MethodPost, "/", map[string]string{CSRFHeader: cookie, "Referer": "http://example.com/users"}, nil, []string{"csrf"}, http.StatusOK},
+		{"cross-site Referer", http.MethodPost, "/", map[string]string{CSRFHeader: cookie, "Referer": "https://evil.test/x"}, nil, []string{"csrf"}, http.StatusForbidden},
+		{"API token only", http.MethodPost, "/api", map[string]string{"Authorization": "Bearer " + apiTok}, nil, nil, http.StatusOK},
+		{"JWT only", http.MethodPost, "/api", map[string]string{"Authorization": "Bearer " + jwtTok}, nil, nil, http.StatusOK},
+		{"unknown API token", http.MethodPost, "/api", map[string]string{"Authorization": "Bearer hf_x"}, nil, []string{"csrf"}, http.StatusForbidden},
+		{"arbitrary bearer", http.MethodPost, "/api", map[string]string{"Authorization": "Bearer proxy-access-token"}, nil, []string{"csrf"}, http.StatusForbidden},
+		{"bearer with session cookie", http.MethodPost, "/api", map[string]string{"Authorization": "Bearer " + apiTok}, nil, []string{"csrf", "tok"}, http.StatusForbidden},
+		{"proxy path same origin", http.MethodPost, "/module-proxy/demo/save", map[string]string{"Origin": "http://example.com"}, nil, []string{"tok"}, http.StatusOK},
+		{"proxy path cross origin", http.MethodPost, "/module-proxy/demo/save", map[string]string{"Origin": "https://evil.test"}, nil, []string{"tok"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.form.Encode()))
+		if tt.form != nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		for k, v := range tt.header {
+			req.Header.Set(k, v)
+		}
+		for _, name := range tt.cookies {
+			v := "x"
+			if name == csrfCookie {
+				v = cookie
+			}
+			req.AddCookie(&http.Cookie{Name: name, Value: v})
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.code)
+		}
+	}
+}
+
+// В режиме входа по заголовкам прокси Authorization мог подставить сам
+// прокси, поэтому даже действующий Bearer проверку не отключает.
+func TestCSRFBearerBehindAuthProxy(t *testing.T) {
+	setupDB(t)
+	bob := addUser(t, "bob", UserRole)
+	tok, err := NewToken(bob.ID, login(t, bob), lifetimes.Access)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nets, _ := ParseCIDRs("192.0.2.1")
+	SetProxy(ProxyConfig{TrustedProxies: nets, ProxyAuth: true, UserHeader: "X-Remote-User"})
+	t.Cleanup(func() { SetProxy(ProxyConfig{}) })
+	h := CSRF(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, tt := range []struct {
+		user string
+		code int
+	}{{"", http.StatusOK}, {"bob", http.StatusForbidden}} {
+		req := httptest.NewRequest(http.MethodPost, "/api", nil)
+		req.RemoteAddr = "192.0.2.1:4000"
+		req.Header.Set("Authorization", "Bearer "+tok)
+		if tt.user != "" {
+			req.Header.Set("X-Remote-User", tt.user)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.code {
+			t.Errorf("proxy user %q: status %d, want %d", tt.user, rec.Code, tt.code)
+		}
+	}
+}
+
+// Без cookie (или с испорченной) выдаётся новый токен, и он же попадает в
+// контекст запроса для вставки в страницу.
+func TestCSRFIssuesToken(t *testing.T) {
+	var seen string
+	h := CSRF(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { seen = CSRFToken(r) }))
+	for _, v := range []string{"", "short"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if v != "" {
+			req.AddCookie(&http.Cookie{Name: csrfCookie, Value: v})
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		c := rec.Result().Cookies()
+		if len(c) != 1 || c[0].Name != csrfCookie || len(c[0].Value) != 64 || !c[0].HttpOnly {
+			t.Fatalf("cookie %q: got %v", v, c)
+		}
+		if seen != c[0].Value {
+			t.Fatalf("context token %q, cookie %q", seen, c[0].Value)
+		}
+	}
+}
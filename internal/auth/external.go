@@ -0,0 +1,161 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/ZenithSolitude/Hopefully/internal/db"
+)
+
+// ── External authenticators ───────────────────────────────────────────────────
+
+// SourceLocal — пользователь с паролем в нашей базе. Остальные значения
+// users.auth_source — имена внешних источников (Authenticator.Name).
+const SourceLocal = "local"
+
+// Identity — пользователь, подтверждённый внешним источником.
+type Identity struct {
+	Username   string
+	FullName   string
+	Email      string
+	Roles      []string // роли портала, выведенные из групп источника
+	ExternalID string   // неизменный id в источнике; пусто — привязка по логину
+}
+
+// Authenticator — внешний источник учётных записей (LDAP, AD…).
+// Authenticate возвращает ErrBadCredentials, если логина нет или пароль
+// неверен; любая другая ошибка означает, что источник недоступен.
+type Authenticator interface {
+	Name() string
+	Authenticate(ctx context.Context, username, password string) (*Identity, error)
+}
+
+var ErrAuthUnavailable = errors.New("authentication backend unavailable")
+
+var authenticators []Authenticator
+
+// SetAuthenticators задаёт внешние источники в порядке опроса.
+func SetAuthenticators(a ...Authenticator) { authenticators = a }
+
+// ExternalSource сообщает, что пароль пользователя хранится не у нас —
+// сменить или сбросить его в портале нельзя.
+func (u *User) ExternalSource() bool { return u.AuthSource != "" && u.AuthSource != SourceLocal }
+
+var ErrExternalAccount = errors.New("password is managed by an external directory")
+
+// authenticateExternal проверяет логин во внешних источниках: для уже
+// заведённого пользователя — в его источнике, для нового — во всех по
+// порядку. При успехе создаёт или обновляет пользователя и его роли.
+func authenticateExternal(ctx context.Context, username, password, source string) (*User, error) {
+	if password == "" {
+		return nil, ErrBadCredentials // пустой пароль в LDAP — анонимный bind, который «успешен»
+	}
+	for _, a := range authenticators {
+		if source != "" && a.Name() != source {
+			continue
+		}
+		id, err := a.Authenticate(ctx, username, password)
+		if errors.Is(err, ErrBadCredentials) {
+			continue
+		}
+		if err != nil {
+			log.Printf("auth: %s: %v", a.Name(), err)
+			return nil, fmt.Errorf("%w: %s", ErrAuthUnavailable, a.Name())
+		}
+		return provision(a.Name(), id)
+	}
+	return nil, ErrBadCredentials
+}
+
+// provision заводит пользователя внешнего источника при первом входе и при
+// каждом следующем обновляет имя, email и роли по данным источника.
+// Если источник сообщает ExternalID, пользователь ищется по нему, а логин
+// нужен только для новой учётной записи и потом не меняется.
+func provision(source string, id *Identity) (*User, error) {
+	roleIDs, err := roleIDsByName(id.Roles)
+	if err != nil {
+		return nil, err
+	}
+	if len(roleIDs) == 0 {
+		log.Printf("auth: %s: user %q has no mapped roles, login refused", source, id.Username)
+		return nil, ErrBadCredentials
+	}
+	var uid int64
+	if id.ExternalID != "" {
+		err = db.DB.QueryRow(`SELECT id FROM users WHERE auth_source = ? AND external_id = ?`, source, id.ExternalID).Scan(&uid)
+	} else {
+		var current string
+		err = db.DB.QueryRow(`SELECT id, auth_source FROM users WHERE username = ?`, id.Username).Scan(&uid, &current)
+		if err == nil && current != source {
+			// Локальный или чужой внешний пользователь с тем же логином — не перехватываем
+			log.Printf("auth: %s: user %q already exists with source %q, login refused", source, id.Username, current)
+			return nil, ErrBadCredentials
+		}
+	}
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		if id.Username == "" {
+			log.Printf("auth: %s: no username for %q, login refused", source, id.ExternalID)
+			return nil, ErrBadCredentials
+		}
+		var taken bool
+		if err := db.DB.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)`, id.Username).Scan(&taken); err != nil {
+			return nil, err
+		}
+		if taken {
+			// В том числе учётная запись этого же источника, заведённая до
+			// привязки по ExternalID: кто за ней стоит, по логину не понять
+			log.Printf("auth: %s: username %q belongs to another account, login of %q refused", source, id.Username, id.ExternalID)
+			return nil, ErrBadCredentials
+		}
+		res, err := db.DB.Exec(
+			`INSERT INTO users (username, password, full_name, email, auth_source, external_id) VALUES (?, '!', ?, ?, ?, NULLIF(?, ''))`,
+			id.Username, id.FullName, id.Email, source, id.ExternalID)
+		if err != nil {
+			return nil, err
+		}
+		uid, _ = res.LastInsertId()
+		log.Printf("auth: provisioned %s user %q", source, id.Username)
+	case err != nil:
+		return nil, err
+	default:
+		if _, err := db.DB.Exec(`UPDATE users SET full_name = ?, email = ? WHERE id = ?`, id.FullName, id.Email, uid); err != nil {
+			return nil, err
+		}
+	}
+	if err := SetUserRoles(uid, roleIDs); errors.Is(err, ErrLastAdmin) {
+		log.Printf("auth: %s: keeping roles of %q: %v", source, id.Username, err)
+	} else if err != nil {
+		return nil, err
+	}
+	return GetByID(uid)
+}
+
+func roleIDsByName(names []string) ([]int64, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	q := `SELECT id FROM roles WHERE name IN (?` + strings.Repeat(",?", len(names)-1) + `)`
+	args := make([]any, len(names))
+	for i, n := range names {
+		args[i] = n
+	}
+	rows, err := db.DB.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
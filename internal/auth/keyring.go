@@ -0,0 +1,215 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ── Signing keys ──────────────────────────────────────────────────────────────
+
+// Токены портала (сессии, второй шаг входа, состояние OIDC) подписываются
+// текущим ключом из keys.json в каталоге данных, его id — в заголовке kid.
+// После ротации прежний ключ ещё проверяет подписи до своего expires —
+// пользователи не выходят разом. Сервер перечитывает файл, заметив, что он
+// изменился: ротация не требует перезапуска.
+//
+// Файл создаётся при первом запуске из SECRET_KEY с kid "legacy" — этим же
+// ключом проверяются токены без kid, выданные до появления keys.json.
+
+const (
+	KeysFile  = "keys.json"
+	legacyKID = "legacy"
+
+	keysCheckEvery = 5 * time.Second
+)
+
+type SigningKey struct {
+	KID     string     `json:"kid"`
+	Key     string     `json:"key"` // hex
+	Created time.Time  `json:"created"`
+	Expires *time.Time `json:"expires,omitempty"` // только проверка подписи до этого момента; nil — бессрочно
+}
+
+// Active — ключ ещё годится для проверки подписи.
+func (k SigningKey) Active() bool { return k.Expires == nil || time.Now().Before(*k.Expires) }
+
+type Keyring struct {
+	Current string       `json:"current"`
+	Keys    []SigningKey `json:"keys"`
+}
+
+func (kr *Keyring) find(kid string) *SigningKey {
+	for i := range kr.Keys {
+		if kr.Keys[i].KID == kid {
+			return &kr.Keys[i]
+		}
+	}
+	return nil
+}
+
+var keys struct {
+	sync.Mutex
+	path      string
+	ring      *Keyring
+	mod       time.Time
+	checkedAt time.Time
+}
+
+var ErrNoKeyring = errors.New("keyring does not exist")
+
+// LoadKeyring читает keys.json из каталога данных.
+func LoadKeyring(dataDir string) (*Keyring, error) {
+	b, err := os.ReadFile(filepath.Join(dataDir, KeysFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoKeyring
+	}
+	if err != nil {
+		return nil, err
+	}
+	kr := &Keyring{}
+	if err := json.Unmarshal(b, kr); err != nil {
+		return nil, fmt.Errorf("%s: %w", KeysFile, err)
+	}
+	cur := kr.find(kr.Current)
+	if cur == nil {
+		return nil, fmt.Errorf("%s: current key %q not found", KeysFile, kr.Current)
+	}
+	if _, err := hex.DecodeString(cur.Key); err != nil || cur.Key == "" {
+		return nil, fmt.Errorf("%s: key %q is not valid hex", KeysFile, cur.KID)
+	}
+	return kr, nil
+}
+
+func saveKeyring(dataDir string, kr *Keyring) error {
+	b, err := json.MarshalIndent(kr, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dataDir, KeysFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// RotateKeys создаёт новый текущий ключ. Прежний текущий проверяет подписи
+// ещё grace (0 — сразу перестаёт: все сеансы завершатся), ключи с истёкшим
+// сроком удаляются из файла.
+func RotateKeys(dataDir string, grace time.Duration) (*SigningKey, error) {
+	kr, err := LoadKeyring(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	until := now.Add(grace)
+	var kept []SigningKey
+	for _, k := range kr.Keys {
+		// Старые ключи только проверяют подписи и не дольше grace
+		if k.Expires == nil || k.Expires.After(until) {
+			k.Expires = &until
+		}
+		if k.Active() {
+			kept = append(kept, k)
+		}
+	}
+	nk := newSigningKey(now)
+	kr.Current, kr.Keys = nk.KID, append([]SigningKey{nk}, kept...)
+	if err := saveKeyring(dataDir, kr); err != nil {
+		return nil, err
+	}
+	return &nk, nil
+}
+
+func newSigningKey(now time.Time) SigningKey {
+	b := make([]byte, 32)
+	rand.Read(b)
+	id := make([]byte, 3)
+	rand.Read(id)
+	return SigningKey{KID: now.Format("20060102") + "-" + hex.EncodeToString(id), Key: hex.EncodeToString(b), Created: now}
+}
+
+// initKeys загружает связку ключей, при первом запуске создаёт её из secret.
+func initKeys(dataDir, secret string) error {
+	kr, err := LoadKeyring(dataDir)
+	if errors.Is(err, ErrNoKeyring) {
+		if secret == "" {
+			return errors.New("SECRET_KEY is required to create " + KeysFile)
+		}
+		kr = &Keyring{Current: legacyKID, Keys: []SigningKey{{
+			KID: legacyKID, Key: hex.EncodeToString([]byte(secret)), Created: time.Now().UTC().Truncate(time.Second)}}}
+		if err = saveKeyring(dataDir, kr); err == nil {
+			log.Printf("auth: created %s from SECRET_KEY", KeysFile)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	st, _ := os.Stat(filepath.Join(dataDir, KeysFile))
+	keys.Lock()
+	defer keys.Unlock()
+	keys.path, keys.ring, keys.checkedAt = dataDir, kr, time.Now()
+	if st != nil {
+		keys.mod = st.ModTime()
+	}
+	return nil
+}
+
+// keyring — текущая связка; раз в keysCheckEvery сверяет время изменения
+// файла и перечитывает его после ротации.
+func keyring() *Keyring {
+	keys.Lock()
+	defer keys.Unlock()
+	if keys.path != "" && time.Since(keys.checkedAt) > keysCheckEvery {
+		keys.checkedAt = time.Now()
+		if st, err := os.Stat(filepath.Join(keys.path, KeysFile)); err == nil && !st.ModTime().Equal(keys.mod) {
+			if kr, err := LoadKeyring(keys.path); err != nil {
+				log.Printf("auth: reload %s: %v (keeping previous keys)", KeysFile, err)
+			} else {
+				keys.ring, keys.mod = kr, st.ModTime()
+				log.Printf("auth: reloaded %s, current key %s", KeysFile, kr.Current)
+			}
+		}
+	}
+	return keys.ring
+}
+
+// sign подписывает claims текущим ключом.
+func sign(c jwt.Claims) (string, error) {
+	kr := keyring()
+	k := kr.find(kr.Current)
+	key, err := hex.DecodeString(k.Key)
+	if err != nil {
+		return "", err
+	}
+	t := jwt.NewWithClaims(jwt.SigningMethodHS256, c)
+	t.Header["kid"] = k.KID
+	return t.SignedString(key)
+}
+
+// verifyKey — jwt.Keyfunc для токенов портала: ключ по kid, если он ещё
+// действует. Токен без kid — выпущенный до keys.json, ключом "legacy".
+func verifyKey(t *jwt.Token) (any, error) {
+	if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, fmt.Errorf("unexpected method")
+	}
+	kid, _ := t.Header["kid"].(string)
+	if kid == "" {
+		kid = legacyKID
+	}
+	k := keyring().find(kid)
+	if k == nil || !k.Active() {
+		return nil, fmt.Errorf("unknown or retired key %q", kid)
+	}
+	return hex.DecodeString(k.Key)
+}
@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signWith подписывает токен ключом key (hex) с заголовком kid; пустой kid —
+// токен без заголовка, как до появления keys.json.
+func signWith(t *testing.T, kid, key string) string {
+	t.Helper()
+	b, err := hex.DecodeString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "1"})
+	if kid != "" {
+		tok.Header["kid"] = kid
+	}
+	s, err := tok.SignedString(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestVerifyKey(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now().UTC()
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	cur, grace, retired := newSigningKey(now), newSigningKey(now), newSigningKey(now)
+	grace.KID, retired.KID = "grace", "retired"
+	grace.Expires, retired.Expires = &future, &past
+	legacy := SigningKey{KID: legacyKID, Key: hex.EncodeToString([]byte("test-secret")), Expires: &future}
+	if err := saveKeyring(dir, &Keyring{Current: cur.KID, Keys: []SigningKey{cur, grace, retired, legacy}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := initKeys(dir, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	none, err := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{"sub": "1"}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := sign(jwt.MapClaims{"sub": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		tok  string
+		ok   bool
+	}{
+		{"sign", signed, true},
+		{"current", signWith(t, cur.KID, cur.Key), true},
+		{"previous within grace", signWith(t, "grace", grace.Key), true},
+		{"no kid is legacy", signWith(t, "", legacy.Key), true},
+		{"retired", signWith(t, "retired", retired.Key), false},
+		{"unknown kid", signWith(t, "unknown", cur.Key), false},
+		{"kid of another key", signWith(t, "grace", cur.Key), false},
+		{"no kid, not legacy key", signWith(t, "", cur.Key), false},
+		{"alg none", none, false},
+	}
+	for _, tt := range tests {
+		_, err := jwt.Parse(tt.tok, verifyKey)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v", tt.name, err)
+		}
+	}
+}
+
+// После ротации без grace токены прежнего ключа больше не проходят, а
+// новые подписываются новым ключом.
+func TestRotateKeys(t *testing.T) {
+	dir := setupDB(t)
+	old, err := sign(jwt.MapClaims{"sub": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nk, err := RotateKeys(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := initKeys(dir, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jwt.Parse(old, verifyKey); err == nil {
+		t.Fatal("token of the rotated key still verifies")
+	}
+	fresh, err := sign(jwt.MapClaims{"sub": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := jwt.Parse(fresh, verifyKey)
+	if err != nil || tok.Header["kid"] != nk.KID {
+		t.Fatalf("fresh token: kid %v, err %v", tok.Header["kid"], err)
+	}
+}
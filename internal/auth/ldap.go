@@ -0,0 +1,262 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ── LDAP / Active Directory ───────────────────────────────────────────────────
+
+// Вход через каталог: сервисная учётка ищет пользователя по логину, затем
+// выполняется bind с его DN и введённым паролем. Роли портала выводятся из
+// групп пользователя по GroupRoles; пароль у нас не хранится. Пользователь
+// портала заводится под логином из каталога (UsernameAttr), а не под тем,
+// что ввели в форму: AD сравнивает логины без учёта регистра, и "Alice" с
+// "alice" — одна учётная запись.
+
+type LDAPConfig struct {
+	URL          string // ldap://host:389 или ldaps://host:636
+	BindDN       string // сервисная учётка для поиска; пусто — анонимный поиск
+	BindPassword string
+	BaseDN       string
+	UserFilter   string // %s — экранированный логин
+	UsernameAttr string // атрибут с логином; пусто — sAMAccountName, а без него uid
+	NameAttr     string
+	MailAttr     string
+	// GroupFilter ищет группы пользователя (%s — его DN) в GroupBaseDN.
+	// Пусто — группы берутся из атрибута memberOf (AD, OpenLDAP с overlay memberof).
+	GroupFilter        string
+	GroupBaseDN        string
+	GroupRoles         map[string][]string // DN группы → роли портала
+	DefaultRole        string              // роль, если ни одна группа не подошла; пусто — вход запрещён
+	StartTLS           bool
+	InsecureSkipVerify bool
+	Timeout            time.Duration
+}
+
+// Фильтры по умолчанию подходят для OpenLDAP; для AD —
+// "(&(objectClass=user)(sAMAccountName=%s))".
+const (
+	DefaultLDAPUserFilter = "(&(objectClass=person)(uid=%s))"
+	DefaultLDAPTimeout    = 10 * time.Second
+)
+
+// ldapConn — то, что нужно от соединения; подменяется ldapDial в тестах
+// с фейковым сервером.
+type ldapConn interface {
+	Bind(username, password string) error
+	Search(req *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close() error
+}
+
+var ldapDial = func(c LDAPConfig) (ldapConn, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	tc := &tls.Config{ServerName: u.Hostname(), InsecureSkipVerify: c.InsecureSkipVerify}
+	conn, err := ldap.DialURL(c.URL, ldap.DialWithDialer(&net.Dialer{Timeout: c.Timeout}), ldap.DialWithTLSConfig(tc))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(c.Timeout)
+	if c.StartTLS {
+		if err := conn.StartTLS(tc); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("starttls: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+type ldapAuth struct{ cfg LDAPConfig }
+
+// NewLDAP — источник учётных записей в LDAP/AD.
+func NewLDAP(c LDAPConfig) Authenticator {
+	if c.UserFilter == "" {
+		c.UserFilter = DefaultLDAPUserFilter
+	}
+	if c.GroupBaseDN == "" {
+		c.GroupBaseDN = c.BaseDN
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = DefaultLDAPTimeout
+	}
+	roles := make(map[string][]string, len(c.GroupRoles))
+	for dn, r := range c.GroupRoles {
+		roles[normDN(dn)] = append(roles[normDN(dn)], r...)
+	}
+	c.GroupRoles = roles
+	return &ldapAuth{cfg: c}
+}
+
+func (a *ldapAuth) Name() string { return "ldap" }
+
+func (a *ldapAuth) Authenticate(ctx context.Context, username, password string) (*Identity, error) {
+	if username == "" || password == "" {
+		return nil, ErrBadCredentials
+	}
+	conn, err := ldapDial(a.cfg)
+	if err != nil {
+		return nil, fmt.Errorf("dial: %w", err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if err := a.serviceBind(conn); err != nil {
+		return nil, err
+	}
+	res, err := conn.Search(ldap.NewSearchRequest(
+		a.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(a.cfg.UserFilter, ldap.EscapeFilter(username)),
+		a.attrs(), nil))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf("search user: %w", err)
+	}
+	if res == nil || len(res.Entries) != 1 {
+		if res != nil && len(res.Entries) > 1 {
+			log.Printf("auth: ldap: filter matches several entries for %q", username)
+		}
+		return nil, ErrBadCredentials
+	}
+	entry := res.Entries[0]
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrBadCredentials
+		}
+		return nil, fmt.Errorf("bind user: %w", err)
+	}
+	login := a.username(entry)
+	if login == "" {
+		return nil, fmt.Errorf("%s has no username attribute", entry.DN)
+	}
+
+	groups := entry.GetAttributeValues("memberOf")
+	if a.cfg.GroupFilter != "" {
+		// Права на чтение групп обычно есть у сервисной учётки, а не у пользователя
+		if err := a.serviceBind(conn); err != nil {
+			return nil, err
+		}
+		gres, err := conn.Search(ldap.NewSearchRequest(
+			a.cfg.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+			fmt.Sprintf(a.cfg.GroupFilter, ldap.EscapeFilter(entry.DN)),
+			[]string{"dn"}, nil))
+		if err != nil {
+			return nil, fmt.Errorf("search groups: %w", err)
+		}
+		groups = nil
+		for _, g := range gres.Entries {
+			groups = append(groups, g.DN)
+		}
+	}
+	id := &Identity{
+		Username: login,
+		FullName: entry.GetAttributeValue(a.cfg.NameAttr),
+		Email:    entry.GetAttributeValue(a.cfg.MailAttr),
+		Roles:    a.roles(groups),
+	}
+	return id, nil
+}
+
+func (a *ldapAuth) serviceBind(conn ldapConn) error {
+	if a.cfg.BindDN == "" {
+		return nil
+	}
+	if err := conn.Bind(a.cfg.BindDN, a.cfg.BindPassword); err != nil {
+		return fmt.Errorf("service bind: %w", err)
+	}
+	return nil
+}
+
+func (a *ldapAuth) attrs() []string {
+	attrs := append([]string{"memberOf"}, a.usernameAttrs()...)
+	for _, at := range []string{a.cfg.NameAttr, a.cfg.MailAttr} {
+		if at != "" {
+			attrs = append(attrs, at)
+		}
+	}
+	return attrs
+}
+
+func (a *ldapAuth) usernameAttrs() []string {
+	if a.cfg.UsernameAttr != "" {
+		return []string{a.cfg.UsernameAttr}
+	}
+	return []string{"sAMAccountName", "uid"}
+}
+
+// username — логин пользователя так, как он записан в каталоге.
+func (a *ldapAuth) username(entry *ldap.Entry) string {
+	for _, at := range a.usernameAttrs() {
+		if v := strings.TrimSpace(entry.GetAttributeValue(at)); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// roles — роли портала по DN групп, без повторов.
+func (a *ldapAuth) roles(groups []string) []string {
+	var out []string
+	seen := map[string]bool{}
+	for _, g := range groups {
+		for _, r := range a.cfg.GroupRoles[normDN(g)] {
+			if !seen[r] {
+				seen[r] = true
+				out = append(out, r)
+			}
+		}
+	}
+	if len(out) == 0 && a.cfg.DefaultRole != "" {
+		out = []string{a.cfg.DefaultRole}
+	}
+	return out
+}
+
+// normDN приводит DN к виду для сравнения: без пробелов вокруг разделителей
+// и в нижнем регистре ("CN=Admins, DC=corp" == "cn=admins,dc=corp").
+func normDN(s string) string {
+	dn, err := ldap.ParseDN(s)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(s))
+	}
+	rdns := make([]string, len(dn.RDNs))
+	for i, rdn := range dn.RDNs {
+		parts := make([]string, len(rdn.Attributes))
+		for j, at := range rdn.Attributes {
+			parts[j] = strings.ToLower(at.Type) + "=" + strings.ToLower(at.Value)
+		}
+		rdns[i] = strings.Join(parts, "+")
+	}
+	return strings.Join(rdns, ",")
+}
+
+// ParseGroupRoles разбирает соответствие групп ролям из конфигурации:
+// "cn=admins,ou=groups,dc=corp:admin;cn=staff,ou=groups,dc=corp:user".
+// DN содержит запятые и знаки "=", поэтому роль отделяется последним ':'.
+// В том же формате задаётся соответствие ролям для OIDC.
+func ParseGroupRoles(s string) (map[string][]string, error) {
+	out := map[string][]string{}
+	for _, pair := range strings.Split(s, ";") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		i := strings.LastIndex(pair, ":")
+		if i <= 0 || i == len(pair)-1 {
+			return nil, errors.New("expected group-dn:role in " + pair)
+		}
+		dn, role := strings.TrimSpace(pair[:i]), strings.TrimSpace(pair[i+1:])
+		out[dn] = append(out[dn], role)
+	}
+	return out, nil
+}
@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// fakeDir — каталог в памяти вместо сервера LDAP. Поиск понимает только
+// фильтр по uid, как DefaultLDAPUserFilter, и без учёта регистра, как AD.
+type fakeDir struct {
+	entries   []*ldap.Entry
+	passwords map[string]string // DN → пароль
+}
+
+func (d *fakeDir) Bind(dn, password string) error {
+	if p, ok := d.passwords[dn]; ok && p == password {
+		return nil
+	}
+	return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+}
+
+func (d *fakeDir) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	i := strings.Index(req.Filter, "(uid=")
+	if i < 0 {
+		return &ldap.SearchResult{}, nil
+	}
+	login := req.Filter[i+len("(uid="):]
+	login = login[:strings.Index(login, ")")]
+	res := &ldap.SearchResult{}
+	for _, e := range d.entries {
+		if strings.EqualFold(e.GetAttributeValue("uid"), login) {
+			res.Entries = append(res.Entries, e)
+		}
+	}
+	return res, nil
+}
+
+func (d *fakeDir) Close() error { return nil }
+
+func setupLDAP(t *testing.T) {
+	t.Helper()
+	dir := &fakeDir{
+		entries: []*ldap.Entry{
+			ldap.NewEntry("uid=alice,ou=people,dc=corp", map[string][]string{
+				"uid": {"alice"}, "cn": {"Alice Liddell"}, "mail": {"alice@corp"},
+				"memberOf": {"CN=Portal Admins, OU=Groups, DC=corp"},
+			}),
+			ldap.NewEntry("uid=carol,ou=people,dc=corp", map[string][]string{
+				"uid": {"carol"}, "cn": {"Carol"},
+				"memberOf": {"cn=staff,ou=groups,dc=corp", "cn=unrelated,ou=groups,dc=corp"},
+			}),
+			ldap.NewEntry("uid=dave,ou=people,dc=corp", map[string][]string{
+				"uid": {"dave"}, "cn": {"Dave"},
+			}),
+		},
+		passwords: map[string]string{
+			"cn=svc,dc=corp":              "svc-pw",
+			"uid=alice,ou=people,dc=corp": "alice-pw",
+			"uid=carol,ou=people,dc=corp": "carol-pw",
+			"uid=dave,ou=people,dc=corp":  "dave-pw",
+		},
+	}
+	orig := ldapDial
+	ldapDial = func(LDAPConfig) (ldapConn, error) { return dir, nil }
+	SetAuthenticators(NewLDAP(LDAPConfig{
+		BindDN: "cn=svc,dc=corp", BindPassword: "svc-pw", BaseDN: "dc=corp",
+		NameAttr: "cn", MailAttr: "mail",
+		GroupRoles: map[string][]string{
+			"cn=portal admins,ou=groups,dc=corp": {AdminRole},
+			"cn=staff,ou=groups,dc=corp":         {UserRole},
+		},
+	}))
+	t.Cleanup(func() {
+		ldapDial = orig
+		SetAuthenticators()
+	})
+}
+
+func ldapLogin(username, password string) (*User, error) {
+	return Authenticate(httptest.NewRequest(http.MethodPost, "/login", nil), username, password)
+}
+
+func TestLDAPLogin(t *testing.T) {
+	setupDB(t)
+	setupLDAP(t)
+
+	tests := []struct {
+		login, password string
+		err             error
+		username        string
+		roles           []string
+	}{
+		{"alice", "wrong", ErrBadCredentials, "", nil},
+		{"nobody", "x", ErrBadCredentials, "", nil},
+		{"dave", "dave-pw", ErrBadCredentials, "", nil}, // ни одной группы и нет DefaultRole
+		{"alice", "alice-pw", nil, "alice", []string{AdminRole}},
+		{"Alice", "alice-pw", nil, "alice", []string{AdminRole}},
+		{"carol", "carol-pw", nil, "carol", []string{UserRole}},
+	}
+	var aliceID int64
+	for _, tt := range tests {
+		u, err := ldapLogin(tt.login, tt.password)
+		if !errors.Is(err, tt.err) {
+			t.Fatalf("%s/%s: err = %v, want %v", tt.login, tt.password, err, tt.err)
+		}
+		if err != nil {
+			continue
+		}
+		if err := loadRoles(u); err != nil {
+			t.Fatal(err)
+		}
+		if u.Username != tt.username || u.AuthSource != "ldap" || strings.Join(u.Roles, ",") != strings.Join(tt.roles, ",") {
+			t.Fatalf("%s: got %q source %q roles %v", tt.login, u.Username, u.AuthSource, u.Roles)
+		}
+		if u.Username == "alice" {
+			if aliceID != 0 && u.ID != aliceID {
+				t.Fatalf("%s: new account %d, want %d", tt.login, u.ID, aliceID)
+			}
+			aliceID = u.ID
+		}
+	}
+	if u, _, err := GetByUsername("Alice"); err == nil {
+		t.Fatalf("account provisioned under the typed login: %d", u.ID)
+	}
+}
+
+func TestLDAPDisabledAccount(t *testing.T) {
+	setupDB(t)
+	setupLDAP(t)
+	addUser(t, "root", AdminRole)
+	u, err := ldapLogin("carol", "carol-pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ToggleUserActive(u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ldapLogin("carol", "carol-pw"); !errors.Is(err, ErrBadCredentials) {
+		t.Fatalf("disabled account: err = %v", err)
+	}
+	if _, err := ldapLogin("Carol", "carol-pw"); !errors.Is(err, ErrBadCredentials) {
+		t.Fatalf("disabled account via other case: err = %v", err)
+	}
+}
+
+// Локальный пользователь с тем же логином каталогу не отдаётся.
+func TestLDAPLocalCollision(t *testing.T) {
+	setupDB(t)
+	setupLDAP(t)
+	local := addUser(t, "carol", UserRole)
+	if _, err := ldapLogin("CAROL", "carol-pw"); !errors.Is(err, ErrBadCredentials) {
+		t.Fatalf("err = %v", err)
+	}
+	if u, err := GetByID(local.ID); err != nil || u.AuthSource != SourceLocal {
+		t.Fatalf("local account changed: %+v %v", u, err)
+	}
+}
@@ -0,0 +1,435 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/ZenithSolitude/Hopefully/internal/audit"
+)
+
+// ── OpenID Connect ────────────────────────────────────────────────────────────
+
+// Вход через внешнего провайдера: authorization code + PKCE (S256). state,
+// nonce и code_verifier на время похода к провайдеру лежат в подписанной
+// cookie. ID token проверяется по ключам из jwks_uri (RS256), пользователь
+// заводится или обновляется так же, как из LDAP (см. provision), но
+// привязывается к паре issuer и sub: preferred_username и подобные claims
+// пользователь у многих провайдеров меняет сам.
+
+const (
+	SourceOIDC = "oidc"
+
+	oidcCookie   = "oidc"
+	oidcStateTTL = 10 * time.Minute
+	oidcMetaTTL  = time.Hour
+	oidcKeysMin  = time.Minute // не чаще — перечитывать JWKS ради незнакомого kid
+
+	OIDCCallbackPath = "/login/oidc/callback"
+)
+
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string // пусто — публичный клиент, защищён только PKCE
+	RedirectURL  string // пусто — адрес портала из запроса + OIDCCallbackPath
+	Scopes       []string
+	// UsernameClaim — claim с логином; RolesClaim — с группами или ролями
+	// провайдера, путь через точку для вложенных ("realm_access.roles").
+	UsernameClaim string
+	RolesClaim    string
+	RoleMap       map[string][]string // значение RolesClaim → роли портала
+	DefaultRole   string              // роль, если ничего не подошло; пусто — вход запрещён
+	Label         string              // надпись на кнопке входа
+}
+
+var (
+	ErrOIDCState  = errors.New("oidc: login state missing, expired or mismatched")
+	ErrOIDCDenied = errors.New("oidc: provider returned an error")
+)
+
+// oidcHTTP — клиент для discovery, JWKS и обмена кода.
+var oidcHTTP = &http.Client{Timeout: 10 * time.Second}
+
+type oidcMeta struct {
+	Issuer   string `json:"issuer"`
+	AuthURL  string `json:"authorization_endpoint"`
+	TokenURL string `json:"token_endpoint"`
+	JWKSURI  string `json:"jwks_uri"`
+}
+
+type oidcClient struct {
+	cfg OIDCConfig
+
+	mu     sync.Mutex
+	meta   *oidcMeta
+	metaAt time.Time
+	keys   map[string]*rsa.PublicKey
+	keysAt time.Time
+}
+
+var oidc *oidcClient
+
+// SetOIDC включает вход через провайдера OpenID Connect.
+func SetOIDC(c OIDCConfig) {
+	c.Issuer = strings.TrimSuffix(c.Issuer, "/")
+	if len(c.Scopes) == 0 {
+		c.Scopes = []string{"openid", "profile", "email"}
+	}
+	if c.UsernameClaim == "" {
+		c.UsernameClaim = "preferred_username"
+	}
+	if c.Label == "" {
+		c.Label = "SSO"
+	}
+	oidc = &oidcClient{cfg: c}
+}
+
+// OIDCLabel — надпись на кнопке входа или "", если OIDC не настроен.
+func OIDCLabel() string {
+	if oidc == nil {
+		return ""
+	}
+	return oidc.cfg.Label
+}
+
+type oidcState struct {
+	State    string `json:"st"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"cv"`
+	Redirect string `json:"ru"`
+	jwt.RegisteredClaims
+}
+
+// BeginOIDC запоминает state, nonce и code_verifier в cookie и возвращает
+// адрес страницы входа провайдера.
+func BeginOIDC(w http.ResponseWriter, r *http.Request) (string, error) {
+	if oidc == nil {
+		return "", errors.New("oidc is not configured")
+	}
+	meta, err := oidc.discover()
+	if err != nil {
+		return "", err
+	}
+	st := oidcState{
+		State:    randomURLString(),
+		Nonce:    randomURLString(),
+		Verifier: randomURLString(),
+		Redirect: oidc.redirectURL(r),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{oidcCookie},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(oidcStateTTL)),
+		},
+	}
+	tok, err := sign(st)
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcCookie, Value: tok, Path: "/login", HttpOnly: true,
+		SameSite: http.SameSiteLaxMode, Secure: RequestScheme(r) == "https", MaxAge: int(oidcStateTTL.Seconds())})
+
+	challenge := sha256.Sum256([]byte(st.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oidc.cfg.ClientID},
+		"redirect_uri":          {st.Redirect},
+		"scope":                 {strings.Join(oidc.cfg.Scopes, " ")},
+		"state":                 {st.State},
+		"nonce":                 {st.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(meta.AuthURL, "?") {
+		sep = "&"
+	}
+	return meta.AuthURL + sep + q.Encode(), nil
+}
+
+// FinishOIDC обрабатывает возврат от провайдера: сверяет state, меняет код
+// на токены, проверяет ID token и заводит или обновляет пользователя.
+// Возвращает ErrOIDCState, ErrOIDCDenied, ErrBadCredentials (вход этому
+// пользователю не разрешён), ErrAuthUnavailable или пользователя.
+func FinishOIDC(w http.ResponseWriter, r *http.Request) (*User, error) {
+	if oidc == nil {
+		return nil, errors.New("oidc is not configured")
+	}
+	st, err := oidcPending(r)
+	http.SetCookie(w, &http.Cookie{Name: oidcCookie, Value: "", Path: "/login", MaxAge: -1})
+	if err != nil {
+		return nil, err
+	}
+	q := r.URL.Query()
+	if q.Get("state") != st.State {
+		return nil, ErrOIDCState
+	}
+	if e := q.Get("error"); e != "" {
+		return nil, fmt.Errorf("%w: %s %s", ErrOIDCDenied, e, q.Get("error_description"))
+	}
+	rawID, err := oidc.exchange(q.Get("code"), st)
+	if err != nil {
+		log.Printf("auth: oidc: %v", err)
+		return nil, fmt.Errorf("%w: %s", ErrAuthUnavailable, SourceOIDC)
+	}
+	claims, err := oidc.verify(rawID, st.Nonce)
+	if err != nil {
+		log.Printf("auth: oidc: id token: %v", err)
+		return nil, fmt.Errorf("%w: %s", ErrAuthUnavailable, SourceOIDC)
+	}
+	id := oidc.identity(claims)
+	if id.ExternalID == "" {
+		log.Printf("auth: oidc: id token has no sub")
+		return nil, fmt.Errorf("%w: %s", ErrAuthUnavailable, SourceOIDC)
+	}
+	u, err := provision(SourceOIDC, id)
+	if errors.Is(err, ErrBadCredentials) || (err == nil && !u.IsActive) {
+		audit.Log(audit.Event{Actor: truncate(id.Username, 64), Action: "auth.login_failed", IP: ClientIP(r),
+			Details: map[string]any{"via": SourceOIDC, "sub": id.ExternalID}})
+		return nil, ErrBadCredentials
+	}
+	return u, err
+}
+
+func oidcPending(r *http.Request) (*oidcState, error) {
+	ck, err := r.Cookie(oidcCookie)
+	if err != nil {
+		return nil, ErrOIDCState
+	}
+	st := &oidcState{}
+	_, err = jwt.ParseWithClaims(ck.Value, st, verifyKey, jwt.WithAudience(oidcCookie), jwt.WithExpirationRequired())
+	if err != nil || st.State == "" {
+		return nil, ErrOIDCState
+	}
+	return st, nil
+}
+
+func (o *oidcClient) redirectURL(r *http.Request) string {
+	if o.cfg.RedirectURL != "" {
+		return o.cfg.RedirectURL
+	}
+	return RequestScheme(r) + "://" + RequestHost(r) + OIDCCallbackPath
+}
+
+// discover читает /.well-known/openid-configuration (с кэшем на час).
+func (o *oidcClient) discover() (*oidcMeta, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.meta != nil && time.Since(o.metaAt) < oidcMetaTTL {
+		return o.meta, nil
+	}
+	m := &oidcMeta{}
+	if err := getJSON(o.cfg.Issuer+"/.well-known/openid-configuration", m); err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	if strings.TrimSuffix(m.Issuer, "/") != o.cfg.Issuer {
+		return nil, fmt.Errorf("discovery: issuer %q does not match %q", m.Issuer, o.cfg.Issuer)
+	}
+	if m.AuthURL == "" || m.TokenURL == "" || m.JWKSURI == "" {
+		return nil, errors.New("discovery: endpoints missing")
+	}
+	o.meta, o.metaAt = m, time.Now()
+	return m, nil
+}
+
+func (o *oidcClient) exchange(code string, st *oidcState) (string, error) {
+	if code == "" {
+		return "", errors.New("no code in callback")
+	}
+	meta, err := o.discover()
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {st.Redirect},
+		"code_verifier": {st.Verifier},
+		"client_id":     {o.cfg.ClientID},
+	}
+	req, err := http.NewRequest(http.MethodPost, meta.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if o.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(o.cfg.ClientID), url.QueryEscape(o.cfg.ClientSecret))
+	}
+	resp, err := oidcHTTP.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint: %s: %s", resp.Status, truncate(string(body), 200))
+	}
+	var tr struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return "", fmt.Errorf("token endpoint: %w", err)
+	}
+	if tr.IDToken == "" {
+		return "", errors.New("token endpoint: no id_token in response")
+	}
+	return tr.IDToken, nil
+}
+
+func (o *oidcClient) verify(raw, nonce string) (jwt.MapClaims, error) {
+	meta, err := o.discover()
+	if err != nil {
+		return nil, err
+	}
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(raw, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return o.key(meta.JWKSURI, kid)
+	}, jwt.WithValidMethods([]string{"RS256"}), jwt.WithIssuer(meta.Issuer), jwt.WithAudience(o.cfg.ClientID),
+		jwt.WithExpirationRequired(), jwt.WithIssuedAt(), jwt.WithLeeway(time.Minute))
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, errors.New("nonce mismatch")
+	}
+	if aud, _ := claims.GetAudience(); len(aud) > 1 {
+		if azp, _ := claims["azp"].(string); azp != o.cfg.ClientID {
+			return nil, errors.New("azp does not match client id")
+		}
+	}
+	return claims, nil
+}
+
+// key — открытый ключ провайдера по kid. Незнакомый kid — повод перечитать
+// JWKS: провайдер мог сменить ключи.
+func (o *oidcClient) key(jwksURI, kid string) (*rsa.PublicKey, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if k := o.pick(kid); k != nil {
+		return k, nil
+	}
+	if time.Since(o.keysAt) < oidcKeysMin {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	o.keysAt = time.Now()
+	if err := getJSON(jwksURI, &set); err != nil {
+		return nil, fmt.Errorf("jwks: %w", err)
+	}
+	o.keys = map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(e) == 0 || len(e) > 4 {
+			continue
+		}
+		o.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	if k := o.pick(kid); k != nil {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+// pick — ключ по kid; без kid подходит единственный ключ набора.
+func (o *oidcClient) pick(kid string) *rsa.PublicKey {
+	if kid == "" && len(o.keys) == 1 {
+		for _, k := range o.keys {
+			return k
+		}
+	}
+	return o.keys[kid]
+}
+
+// identity переводит claims ID token в пользователя портала. ExternalID —
+// "issuer#sub" (в issuer фрагмента быть не может); пустой, если нет sub.
+func (o *oidcClient) identity(c jwt.MapClaims) *Identity {
+	str := func(name string) string { s, _ := claimPath(c, name).(string); return strings.TrimSpace(s) }
+	id := &Identity{Username: str(o.cfg.UsernameClaim), FullName: str("name"), Email: str("email")}
+	if sub, _ := c["sub"].(string); sub != "" {
+		id.ExternalID = str("iss") + "#" + sub
+	}
+	var values []string
+	switch v := claimPath(c, o.cfg.RolesClaim).(type) {
+	case string:
+		values = strings.Fields(v)
+	case []any:
+		for _, x := range v {
+			if s, ok := x.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	seen := map[string]bool{}
+	for _, v := range values {
+		for _, r := range o.cfg.RoleMap[v] {
+			if !seen[r] {
+				seen[r] = true
+				id.Roles = append(id.Roles, r)
+			}
+		}
+	}
+	if len(id.Roles) == 0 && o.cfg.DefaultRole != "" {
+		id.Roles = []string{o.cfg.DefaultRole}
+	}
+	return id
+}
+
+func claimPath(c map[string]any, path string) any {
+	if path == "" {
+		return nil
+	}
+	var v any = c
+	for _, p := range strings.Split(path, ".") {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[p]
+	}
+	return v
+}
+
+func getJSON(u string, dst any) error {
+	resp, err := oidcHTTP.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(dst)
+}
+
+func randomURLString() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,220 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/ZenithSolitude/Hopefully/internal/db"
+)
+
+// fakeProvider — провайдер OpenID Connect: discovery, JWKS и token endpoint,
+// который проверяет PKCE и выдаёт подписанный ID token.
+type fakeProvider struct {
+	srv *httptest.Server
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]fakeGrant
+}
+
+type fakeGrant struct {
+	challenge string
+	claims    jwt.MapClaims
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeProvider{key: key, codes: map[string]fakeGrant{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcMeta{Issuer: p.srv.URL, AuthURL: p.srv.URL + "/auth",
+			TokenURL: p.srv.URL + "/token", JWKSURI: p.srv.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		enc := base64.RawURLEncoding.EncodeToString
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA", "use": "sig", "kid": "k1",
+			"n": enc(key.N.Bytes()), "e": enc(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		g, ok := p.codes[r.FormValue("code")]
+		delete(p.codes, r.FormValue("code"))
+		p.mu.Unlock()
+		sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if !ok || r.FormValue("grant_type") != "authorization_code" || r.FormValue("client_id") != "portal" ||
+			base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		tok := jwt.NewWithClaims(jwt.SigningMethodRS256, g.claims)
+		tok.Header["kid"] = "k1"
+		raw, err := tok.SignedString(key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": raw})
+	})
+	p.srv = httptest.NewServer(mux)
+	t.Cleanup(p.srv.Close)
+	return p
+}
+
+// login проходит вход целиком: BeginOIDC, "страница провайдера", которая
+// выдаёт код на claims, и FinishOIDC. edit может испортить запрос к
+// провайдеру (nonce, challenge) или возврат от него.
+func (p *fakeProvider) login(t *testing.T, claims jwt.MapClaims, edit func(auth, callback url.Values)) (*User, error) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	loc, err := BeginOIDC(rec, httptest.NewRequest(http.MethodGet, "/login/oidc", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := u.Query()
+	if auth.Get("code_challenge_method") != "S256" || auth.Get("client_id") != "portal" {
+		t.Fatalf("authorization request: %s", loc)
+	}
+	callback := url.Values{"state": {auth.Get("state")}, "code": {"code-" + auth.Get("state")}}
+	if edit != nil {
+		edit(auth, callback)
+	}
+	c := jwt.MapClaims{"iss": p.srv.URL, "aud": "portal", "nonce": auth.Get("nonce"),
+		"iat": time.Now().Unix(), "exp": time.Now().Add(time.Minute).Unix()}
+	for k, v := range claims {
+		c[k] = v
+	}
+	p.mu.Lock()
+	p.codes["code-"+auth.Get("state")] = fakeGrant{challenge: auth.Get("code_challenge"), claims: c}
+	p.mu.Unlock()
+
+	req := httptest.NewRequest(http.MethodGet, OIDCCallbackPath+"?"+callback.Encode(), nil)
+	for _, ck := range rec.Result().Cookies() {
+		req.AddCookie(ck)
+	}
+	return FinishOIDC(httptest.NewRecorder(), req)
+}
+
+func setupOIDC(t *testing.T) *fakeProvider {
+	t.Helper()
+	p := newFakeProvider(t)
+	SetOIDC(OIDCConfig{Issuer: p.srv.URL, ClientID: "portal", RolesClaim: "groups",
+		RoleMap: map[string][]string{"portal-admins": {AdminRole}, "staff": {UserRole}}})
+	t.Cleanup(func() { oidc = nil })
+	return p
+}
+
+func TestOIDCLogin(t *testing.T) {
+	setupDB(t)
+	addUser(t, "root", AdminRole)
+	addUser(t, "carol", UserRole)
+	p := setupOIDC(t)
+
+	alice, err := p.login(t, jwt.MapClaims{"sub": "s-1", "preferred_username": "alice", "name": "Alice",
+		"groups": []string{"portal-admins", "unmapped"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loadRoles(alice); err != nil {
+		t.Fatal(err)
+	}
+	if alice.Username != "alice" || alice.AuthSource != SourceOIDC || len(alice.Roles) != 1 || alice.Roles[0] != AdminRole {
+		t.Fatalf("first login: %+v", alice)
+	}
+
+	// Тот же sub с новым preferred_username — та же учётная запись под прежним логином
+	u, err := p.login(t, jwt.MapClaims{"sub": "s-1", "preferred_username": "alice.new", "name": "Alice N",
+		"groups": []string{"staff"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loadRoles(u); err != nil {
+		t.Fatal(err)
+	}
+	if u.ID != alice.ID || u.Username != "alice" || u.FullName != "Alice N" || u.Roles[0] != UserRole {
+		t.Fatalf("second login: %+v", u)
+	}
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		edit   func(auth, callback url.Values)
+		err    error
+	}{
+		{"other sub takes username", jwt.MapClaims{"sub": "s-2", "preferred_username": "alice", "groups": "staff"}, nil, ErrBadCredentials},
+		{"other sub takes local username", jwt.MapClaims{"sub": "s-3", "preferred_username": "carol", "groups": "staff"}, nil, ErrBadCredentials},
+		{"no mapped roles", jwt.MapClaims{"sub": "s-4", "preferred_username": "dave", "groups": "unmapped"}, nil, ErrBadCredentials},
+		{"no username", jwt.MapClaims{"sub": "s-5", "groups": "staff"}, nil, ErrBadCredentials},
+		{"no sub", jwt.MapClaims{"preferred_username": "erin", "groups": "staff"}, nil, ErrAuthUnavailable},
+		{"state mismatch", jwt.MapClaims{"sub": "s-6", "preferred_username": "frank", "groups": "staff"},
+			func(_, cb url.Values) { cb.Set("state", "forged") }, ErrOIDCState},
+		{"provider error", jwt.MapClaims{"sub": "s-6", "preferred_username": "frank", "groups": "staff"},
+			func(_, cb url.Values) { cb.Del("code"); cb.Set("error", "access_denied") }, ErrOIDCDenied},
+		{"nonce mismatch", jwt.MapClaims{"sub": "s-6", "preferred_username": "frank", "groups": "staff"},
+			func(a, _ url.Values) { a.Set("nonce", "replayed") }, ErrAuthUnavailable},
+		{"wrong code verifier", jwt.MapClaims{"sub": "s-6", "preferred_username": "frank", "groups": "staff"},
+			func(a, _ url.Values) { a.Set("code_challenge", "intercepted") }, ErrAuthUnavailable},
+	}
+	for _, tt := range tests {
+		if _, err := p.login(t, tt.claims, tt.edit); !errors.Is(err, tt.err) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+	var n int
+	db.DB.QueryRow(`SELECT COUNT(*) FROM users WHERE auth_source = ?`, SourceOIDC).Scan(&n)
+	if n != 1 {
+		t.Fatalf("%d oidc accounts, want 1", n)
+	}
+}
+
+// Учётная запись oidc, заведённая до привязки по sub, логином не занимается.
+func TestOIDCLegacyAccount(t *testing.T) {
+	setupDB(t)
+	addUser(t, "root", AdminRole)
+	p := setupOIDC(t)
+	if _, err := db.DB.Exec(`INSERT INTO users (username, password, auth_source) VALUES ('alice', '!', 'oidc')`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.login(t, jwt.MapClaims{"sub": "s-1", "preferred_username": "alice", "groups": "staff"}, nil); !errors.Is(err, ErrBadCredentials) {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestOIDCDisabledAccount(t *testing.T) {
+	setupDB(t)
+	addUser(t, "root", AdminRole)
+	p := setupOIDC(t)
+	claims := jwt.MapClaims{"sub": "s-1", "preferred_username": "alice", "groups": "staff"}
+	u, err := p.login(t, claims, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ToggleUserActive(u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.login(t, claims, nil); !errors.Is(err, ErrBadCredentials) {
+		t.Fatalf("err = %v", err)
+	}
+}
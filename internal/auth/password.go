@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"bufio"
+	_ "embed"
+	"errors"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// ── Password policy ───────────────────────────────────────────────────────────
+
+// PasswordPolicy — требования к новым паролям. Уже заданные пароли не
+// перепроверяются: политика применяется при смене и создании.
+type PasswordPolicy struct {
+	MinLength      int  // минимум символов (рун)
+	MinClasses     int  // сколько классов символов из четырёх: строчные, заглавные, цифры, прочие
+	RejectBreached bool // отклонять пароли из встроенного списка утёкших
+}
+
+var policy = PasswordPolicy{MinLength: 8, MinClasses: 1, RejectBreached: true}
+
+func SetPasswordPolicy(p PasswordPolicy) { policy = p }
+
+// Policy — действующие требования, для подсказок в интерфейсе.
+func Policy() PasswordPolicy { return policy }
+
+var (
+	ErrPasswordTooShort  = errors.New("password is too short")
+	ErrPasswordTooSimple = errors.New("password uses too few character classes")
+	ErrPasswordBreached  = errors.New("password is in the list of breached passwords")
+)
+
+// ValidatePassword проверяет новый пароль на соответствие политике.
+func ValidatePassword(p string) error {
+	if len([]rune(p)) < policy.MinLength {
+		return ErrPasswordTooShort
+	}
+	if charClasses(p) < policy.MinClasses {
+		return ErrPasswordTooSimple
+	}
+	if policy.RejectBreached && Breached(p) {
+		return ErrPasswordBreached
+	}
+	return nil
+}
+
+func charClasses(p string) int {
+	var lower, upper, digit, other bool
+	for _, r := range p {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	n := 0
+	for _, ok := range []bool{lower, upper, digit, other} {
+		if ok {
+			n++
+		}
+	}
+	return n
+}
+
+// breached_passwords.txt — самые частые пароли из публичных утечек, по одному
+// в строке, в нижнем регистре. Вшит в бинарник: проверка работает офлайн.
+//
+//go:embed breached_passwords.txt
+var breachedList string
+
+var breachedSet = sync.OnceValue(func() map[string]struct{} {
+	set := make(map[string]struct{})
+	sc := bufio.NewScanner(strings.NewReader(breachedList))
+	for sc.Scan() {
+		if w := strings.TrimSpace(sc.Text()); w != "" && !strings.HasPrefix(w, "#") {
+			set[w] = struct{}{}
+		}
+	}
+	return set
+})
+
+// Breached сообщает, есть ли пароль во встроенном списке утёкших
+// (без учёта регистра).
+func Breached(p string) bool {
+	_, ok := breachedSet()[strings.ToLower(p)]
+	return ok
+}
@@ -0,0 +1,350 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/ZenithSolitude/Hopefully/internal/db"
+)
+
+// ── Permissions ───────────────────────────────────────────────────────────────
+
+// PermissionInfo — право портала с подписью для интерфейса.
+type PermissionInfo struct {
+	Name  string
+	Label string
+}
+
+// Catalog — права самого портала. Права модулей объявляются в их manifest.json.
+var Catalog = []PermissionInfo{
+	{"dashboard.view", "Дашборд"},
+	{"modules.view", "Список модулей"},
+	{"modules.install", "Установка модулей"},
+	{"modules.manage", "Запуск, остановка и удаление модулей"},
+	{"users.view", "Список пользователей"},
+	{"users.manage", "Управление пользователями"},
+	{"roles.manage", "Управление ролями и доступом"},
+	{"logs.view", "Логи"},
+	{"audit.view", "Журнал действий"},
+	{"system.backup", "Резервные копии и восстановление базы"},
+}
+
+// permRe — имя права или маска: "*", "modules.*", "module.backup.view".
+var permRe = regexp.MustCompile(`^(\*|[a-z0-9_-]+(\.[a-z0-9_-]+)*(\.\*)?)$`)
+
+// ValidPermission — годится ли строка как право роли.
+func ValidPermission(p string) bool { return permRe.MatchString(p) }
+
+// Match сообщает, покрывает ли выданное роли право granted требуемое want.
+// "*" покрывает всё, "modules.*" — всё, что начинается с "modules.".
+func Match(granted, want string) bool {
+	if granted == "*" || granted == want {
+		return true
+	}
+	if prefix, ok := strings.CutSuffix(granted, ".*"); ok {
+		return strings.HasPrefix(want, prefix+".")
+	}
+	return false
+}
+
+// HasPermission — есть ли want среди granted с учётом масок.
+func HasPermission(granted []string, want string) bool {
+	for _, g := range granted {
+		if Match(g, want) {
+			return true
+		}
+	}
+	return false
+}
+
+// Can — есть ли у пользователя право perm. Запрос с API-токеном ограничен
+// ещё и scopes токена.
+func (u *User) Can(perm string) bool {
+	if u == nil || !HasPermission(u.Permissions, perm) {
+		return false
+	}
+	return u.scopes == nil || HasPermission(u.scopes, perm)
+}
+
+// RequirePermission пропускает только пользователей с правом perm. Сама не
+// аутентифицирует: ставится за Middleware, без пользователя в контексте — 403.
+func RequirePermission(perm string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !CtxGet(r).Can(perm) {
+				http.Error(w, "403 Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// loadRoles заполняет Roles и Permissions пользователя из user_roles.
+func loadRoles(u *User) error {
+	rows, err := db.DB.Query(
+		`SELECT r.name, r.permissions FROM roles r JOIN user_roles ur ON ur.role_id = r.id
+		 WHERE ur.user_id = ? ORDER BY r.name`, u.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	u.Roles, u.Permissions = nil, nil
+	for rows.Next() {
+		var name, pj string
+		if err := rows.Scan(&name, &pj); err != nil {
+			return err
+		}
+		var perms []string
+		json.Unmarshal([]byte(pj), &perms)
+		u.Roles = append(u.Roles, name)
+		u.Permissions = append(u.Permissions, perms...)
+	}
+	return rows.Err()
+}
+
+// ── Roles ─────────────────────────────────────────────────────────────────────
+
+// AdminRole — системная роль со всеми правами; users.is_admin повторяет её наличие.
+// UserRole — роль по умолчанию для новых пользователей.
+const (
+	AdminRole = "admin"
+	UserRole  = "user"
+)
+
+var (
+	ErrSystemRole = errors.New("system role cannot be changed")
+	ErrNoRoles    = errors.New("user must have at least one role")
+	roleNameRe    = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{1,31}$`)
+)
+
+type Role struct {
+	ID          int64
+	Name        string
+	Description string
+	Permissions []string
+	IsSystem    bool
+}
+
+// Covers — покрывает ли роль право perm (в т.ч. через маску).
+func (r Role) Covers(perm string) bool { return HasPermission(r.Permissions, perm) }
+
+// Grants — выдано ли право perm роли явно, без масок.
+func (r Role) Grants(perm string) bool {
+	for _, p := range r.Permissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+func ListRoles() ([]Role, error) {
+	rows, err := db.DB.Query(`SELECT id, name, description, permissions, is_system FROM roles ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var roles []Role
+	for rows.Next() {
+		var r Role
+		var pj string
+		if err := rows.Scan(&r.ID, &r.Name, &r.Description, &pj, &r.IsSystem); err != nil {
+			return nil, err
+		}
+		json.Unmarshal([]byte(pj), &r.Permissions)
+		roles = append(roles, r)
+	}
+	return roles, rows.Err()
+}
+
+// SetRolePermission выдаёт (on) или отзывает право perm у роли.
+func SetRolePermission(roleID int64, perm string, on bool) error {
+	var pj string
+	if err := db.DB.QueryRow(`SELECT permissions FROM roles WHERE id = ?`, roleID).Scan(&pj); err != nil {
+		return fmt.Errorf("role %d: %w", roleID, err)
+	}
+	var perms []string
+	json.Unmarshal([]byte(pj), &perms)
+	out := perms[:0]
+	for _, p := range perms {
+		if p != perm {
+			out = append(out, p)
+		}
+	}
+	if on {
+		out = append(out, perm)
+	}
+	b, _ := json.Marshal(out)
+	_, err := db.DB.Exec(`UPDATE roles SET permissions = ? WHERE id = ?`, string(b), roleID)
+	return err
+}
+
+// AssignRole добавляет пользователю роль по имени.
+func AssignRole(uid int64, role string) error {
+	if _, err := db.DB.Exec(
+		`INSERT OR IGNORE INTO user_roles (user_id, role_id) SELECT ?, id FROM roles WHERE name = ?`, uid, role); err != nil {
+		return err
+	}
+	return syncAdmin(db.DB, uid)
+}
+
+// RoleID — id роли по имени.
+func RoleID(name string) (int64, error) {
+	var id int64
+	err := db.DB.QueryRow(`SELECT id FROM roles WHERE name = ?`, name).Scan(&id)
+	return id, err
+}
+
+func GetRole(id int64) (Role, error) {
+	var r Role
+	var pj string
+	err := db.DB.QueryRow(`SELECT id, name, description, permissions, is_system FROM roles WHERE id = ?`, id).
+		Scan(&r.ID, &r.Name, &r.Description, &pj, &r.IsSystem)
+	json.Unmarshal([]byte(pj), &r.Permissions)
+	return r, err
+}
+
+func validatePermissions(perms []string) error {
+	for _, p := range perms {
+		if !ValidPermission(p) {
+			return fmt.Errorf("invalid permission %q", p)
+		}
+	}
+	return nil
+}
+
+func CreateRole(name, description string, perms []string) error {
+	if !roleNameRe.MatchString(name) {
+		return fmt.Errorf("role name must match %s", roleNameRe)
+	}
+	if err := validatePermissions(perms); err != nil {
+		return err
+	}
+	b, _ := json.Marshal(perms)
+	_, err := db.DB.Exec(`INSERT INTO roles (name, description, permissions) VALUES (?, ?, ?)`, name, description, string(b))
+	return err
+}
+
+// UpdateRole меняет описание и права роли. Права роли admin неизменны.
+func UpdateRole(id int64, description string, perms []string) error {
+	r, err := GetRole(id)
+	if err != nil {
+		return err
+	}
+	if r.Name == AdminRole {
+		return ErrSystemRole
+	}
+	if err := validatePermissions(perms); err != nil {
+		return err
+	}
+	b, _ := json.Marshal(perms)
+	_, err = db.DB.Exec(`UPDATE roles SET description = ?, permissions = ? WHERE id = ?`, description, string(b), id)
+	return err
+}
+
+// DeleteRole удаляет несистемную роль. Пользователи, у которых она была
+// единственной, получают роль user.
+func DeleteRole(id int64) error {
+	r, err := GetRole(id)
+	if err != nil {
+		return err
+	}
+	if r.IsSystem {
+		return ErrSystemRole
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM user_roles WHERE role_id = ?`, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM roles WHERE id = ?`, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		`INSERT OR IGNORE INTO user_roles (user_id, role_id)
+		 SELECT u.id, r.id FROM users u, roles r
+		 WHERE r.name = 'user' AND NOT EXISTS (SELECT 1 FROM user_roles ur WHERE ur.user_id = u.id)`); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UserRoleNames — имена ролей каждого пользователя.
+func UserRoleNames() (map[int64][]string, error) {
+	rows, err := db.DB.Query(
+		`SELECT ur.user_id, r.name FROM user_roles ur JOIN roles r ON r.id = ur.role_id ORDER BY r.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := map[int64][]string{}
+	for rows.Next() {
+		var uid int64
+		var name string
+		if err := rows.Scan(&uid, &name); err != nil {
+			return nil, err
+		}
+		out[uid] = append(out[uid], name)
+	}
+	return out, rows.Err()
+}
+
+// SetUserRoles заменяет роли пользователя и синхронизирует users.is_admin.
+func SetUserRoles(uid int64, roleIDs []int64) error {
+	if len(roleIDs) == 0 {
+		return ErrNoRoles
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := replaceUserRoles(tx, uid, roleIDs); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// replaceUserRoles заменяет роли пользователя в транзакции tx и проверяет,
+// что активный администратор остался.
+func replaceUserRoles(tx *sql.Tx, uid int64, roleIDs []int64) error {
+	if _, err := tx.Exec(`DELETE FROM user_roles WHERE user_id = ?`, uid); err != nil {
+		return err
+	}
+	if err := addUserRoles(tx, uid, roleIDs); err != nil {
+		return err
+	}
+	return ensureActiveAdmin(tx)
+}
+
+// addUserRoles выдаёт пользователю роли и синхронизирует users.is_admin.
+func addUserRoles(e execer, uid int64, roleIDs []int64) error {
+	for _, id := range roleIDs {
+		if _, err := e.Exec(`INSERT INTO user_roles (user_id, role_id) VALUES (?, ?)`, uid, id); err != nil {
+			return fmt.Errorf("role %d: %w", id, err)
+		}
+	}
+	return syncAdmin(e, uid)
+}
+
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func syncAdmin(e execer, uid int64) error {
+	_, err := e.Exec(
+		`UPDATE users SET is_admin = EXISTS (
+			SELECT 1 FROM user_roles ur JOIN roles r ON r.id = ur.role_id
+			WHERE ur.user_id = users.id AND r.name = ?)
+		 WHERE id = ?`, AdminRole, uid)
+	return err
+}
@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		granted, want string
+		ok            bool
+	}{
+		{"*", "users.manage", true},
+		{"*", "module.backup.view", true},
+		{"users.manage", "users.manage", true},
+		{"users.manage", "users.view", false},
+		{"users.*", "users.view", true},
+		{"users.*", "users", false},
+		{"users.*", "usersx.view", false},
+		{"module.*", "module.backup.view", true},
+		{"module.backup.*", "module.other.view", false},
+		{"users.view", "users.*", false},
+	}
+	for _, tt := range tests {
+		if got := Match(tt.granted, tt.want); got != tt.ok {
+			t.Errorf("Match(%q, %q) = %v, want %v", tt.granted, tt.want, got, tt.ok)
+		}
+	}
+}
+
+func TestUserCan(t *testing.T) {
+	tests := []struct {
+		name   string
+		perms  []string
+		scopes []string
+		want   string
+		ok     bool
+	}{
+		{"role grants", []string{"users.view"}, nil, "users.view", true},
+		{"role lacks", []string{"users.view"}, nil, "users.manage", false},
+		{"mask", []string{"modules.*"}, nil, "modules.install", true},
+		{"admin", []string{"*"}, nil, "roles.manage", true},
+		{"scope allows", []string{"*"}, []string{"modules.view"}, "modules.view", true},
+		{"scope narrows admin", []string{"*"}, []string{"modules.view"}, "users.manage", false},
+		{"scope mask", []string{"*"}, []string{"modules.*"}, "modules.manage", true},
+		{"scope beyond role", []string{"modules.view"}, []string{"*"}, "users.manage", false},
+		{"empty scopes deny", []string{"*"}, []string{}, "dashboard.view", false},
+	}
+	for _, tt := range tests {
+		u := &User{Permissions: tt.perms, scopes: tt.scopes}
+		if got := u.Can(tt.want); got != tt.ok {
+			t.Errorf("%s: Can(%q) = %v, want %v", tt.name, tt.want, got, tt.ok)
+		}
+	}
+	var nobody *User
+	if nobody.Can("dashboard.view") {
+		t.Error("nil user must not have permissions")
+	}
+}
+
+func TestCreateUser(t *testing.T) {
+	setupDB(t)
+	u := addUser(t, "bob", UserRole)
+	if u.IsAdmin || len(u.Roles) != 1 || u.Roles[0] != UserRole {
+		t.Fatalf("roles = %v, admin = %v", u.Roles, u.IsAdmin)
+	}
+	if _, err := CreateUser("bob", "Correct-Horse-42", "", "", []int64{1}); !errors.Is(err, ErrUsernameTaken) {
+		t.Fatalf("duplicate: err = %v", err)
+	}
+	// Несуществующая роль откатывает и саму запись: повтор с верной ролью проходит
+	if _, err := CreateUser("carol", "Correct-Horse-42", "", "", []int64{999}); err == nil {
+		t.Fatal("unknown role accepted")
+	}
+	id, _ := RoleID(AdminRole)
+	if _, err := CreateUser("carol", "Correct-Horse-42", "", "", []int64{id}); err != nil {
+		t.Fatalf("retry after failed role assignment: %v", err)
+	}
+	if c, _, _ := GetByUsername("carol"); !c.IsAdmin {
+		t.Fatal("is_admin not synced")
+	}
+}
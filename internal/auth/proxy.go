@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ZenithSolitude/Hopefully/internal/audit"
+)
+
+// ── Trusted reverse proxy ─────────────────────────────────────────────────────
+
+// Портал может стоять за прокси. Заголовкам X-Forwarded-For/-Host/-Proto
+// верим только от адресов из TrustedProxies. Если включён ProxyAuth, прокси
+// (oauth2-proxy, Authelia…) сам аутентифицирует пользователя и передаёт логин
+// и группы в заголовках — форма входа не нужна, пользователь заводится
+// автоматически (источник SourceProxy).
+
+const SourceProxy = "proxy"
+
+type ProxyConfig struct {
+	TrustedProxies []*net.IPNet
+	ProxyAuth      bool   // входить по заголовкам прокси
+	UserHeader     string // логин, обычно X-Remote-User
+	GroupsHeader   string // группы через запятую
+	NameHeader     string // необязательные имя и email
+	EmailHeader    string
+	GroupRoles     map[string][]string // группа прокси → роли портала
+	DefaultRole    string              // роль, если ни одна группа не подошла; пусто — вход запрещён
+}
+
+var proxy ProxyConfig
+
+func SetProxy(c ProxyConfig) { proxy = c }
+
+// ParseCIDRs разбирает список сетей через запятую; адрес без маски — один хост.
+func ParseCIDRs(s string) ([]*net.IPNet, error) {
+	var out []*net.IPNet
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		if !strings.Contains(f, "/") {
+			ip := net.ParseIP(f)
+			if ip == nil {
+				return nil, errors.New("invalid address " + f)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(f)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+func trusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range proxy.TrustedProxies {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// fromTrustedProxy — запрос пришёл напрямую от доверенного прокси.
+func fromTrustedProxy(r *http.Request) bool { return trusted(peerIP(r)) }
+
+// RequestHost — хост, по которому к порталу обратился браузер: за доверенным
+// прокси — из X-Forwarded-Host.
+func RequestHost(r *http.Request) string {
+	if fromTrustedProxy(r) {
+		if h := firstValue(r.Header.Get("X-Forwarded-Host")); h != "" {
+			return h
+		}
+	}
+	return r.Host
+}
+
+// RequestScheme — http или https со стороны браузера.
+func RequestScheme(r *http.Request) string {
+	if fromTrustedProxy(r) {
+		if p := strings.ToLower(firstValue(r.Header.Get("X-Forwarded-Proto"))); p == "http" || p == "https" {
+			return p
+		}
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+func firstValue(h string) string {
+	v, _, _ := strings.Cut(h, ",")
+	return strings.TrimSpace(v)
+}
+
+// ── Header authentication ─────────────────────────────────────────────────────
+
+// proxyIdentity — логин из заголовка доверенного прокси или "".
+func proxyIdentity(r *http.Request) string {
+	if !proxy.ProxyAuth || !fromTrustedProxy(r) {
+		return ""
+	}
+	return strings.TrimSpace(r.Header.Get(proxy.UserHeader))
+}
+
+// ProxyAuthenticated — пользователя уже аутентифицировал прокси, форма входа
+// ему не нужна.
+func ProxyAuthenticated(r *http.Request) bool { return proxyIdentity(r) != "" }
+
+// proxySeen — недавно проверенные наборы заголовков: заводить пользователя
+// и переписывать его роли на каждом запросе незачем.
+var (
+	proxyMu   sync.Mutex
+	proxySeen = map[string]proxyResult{}
+)
+
+type proxyResult struct {
+	uid int64
+	err error
+	at  time.Time
+}
+
+const proxyCacheTTL = 15 * time.Minute
+
+// proxyUser — пользователь по заголовкам прокси; при первом запросе (и раз в
+// proxyCacheTTL) заводит или обновляет его и пишет вход в журнал.
+func proxyUser(r *http.Request, username string) (*User, error) {
+	id := &Identity{
+		Username: truncate(username, 64),
+		FullName: strings.TrimSpace(r.Header.Get(proxy.NameHeader)),
+		Email:    strings.TrimSpace(r.Header.Get(proxy.EmailHeader)),
+	}
+	groups := r.Header.Get(proxy.GroupsHeader)
+	key := strings.Join([]string{id.Username, id.FullName, id.Email, groups}, "\x00")
+
+	proxyMu.Lock()
+	for k, v := range proxySeen {
+		if time.Since(v.at) > proxyCacheTTL {
+			delete(proxySeen, k)
+		}
+	}
+	res, ok := proxySeen[key]
+	if !ok {
+		id.Roles = proxyRoles(groups)
+		u, err := provision(SourceProxy, id)
+		e := audit.Event{Actor: id.Username, Action: "auth.login", IP: ClientIP(r), Details: map[string]any{"via": SourceProxy}}
+		if err == nil {
+			res.uid, e.UserID = u.ID, u.ID
+		} else if errors.Is(err, ErrBadCredentials) {
+			res.err, e.Action = err, "auth.login_failed"
+		} else {
+			proxyMu.Unlock()
+			log.Printf("auth: proxy: %v", err)
+			return nil, err // не кэшируем: ошибка базы может пройти
+		}
+		audit.Log(e)
+		res.at = time.Now()
+		proxySeen[key] = res
+	}
+	proxyMu.Unlock()
+	if res.err != nil {
+		return nil, res.err
+	}
+	return GetByID(res.uid)
+}
+
+func proxyRoles(groups string) []string {
+	var out []string
+	seen := map[string]bool{}
+	for _, g := range strings.Split(groups, ",") {
+		for _, r := range proxy.GroupRoles[strings.TrimSpace(g)] {
+			if !seen[r] {
+				seen[r] = true
+				out = append(out, r)
+			}
+		}
+	}
+	if len(out) == 0 && proxy.DefaultRole != "" {
+		out = []string{proxy.DefaultRole}
+	}
+	return out
+}
@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ZenithSolitude/Hopefully/internal/audit"
+	"github.com/ZenithSolitude/Hopefully/internal/db"
+)
+
+// ── Sessions ──────────────────────────────────────────────────────────────────
+
+// Сессия — строка в sessions, id которой лежит в jti JWT. Удалили строку —
+// токен больше не принимается, даже если его срок не истёк.
+
+var ErrSessionRevoked = errors.New("session revoked or expired")
+
+type Session struct {
+	ID        string
+	IP        string
+	UserAgent string
+	CreatedAt string
+	LastSeen  string
+	ExpiresAt string
+	Current   bool
+}
+
+func sessionTTL(remember bool) time.Duration {
+	if remember {
+		return lifetimes.Remember
+	}
+	return lifetimes.Session
+}
+
+// StartSession создаёт сессию пользователя и ставит cookie с её токеном.
+// remember — «Запомнить меня»: длинная сессия и постоянная cookie.
+func StartSession(w http.ResponseWriter, r *http.Request, uid int64, remember bool) error {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	sid := hex.EncodeToString(b)
+	ua := r.UserAgent()
+	if len(ua) > 255 {
+		ua = ua[:255]
+	}
+	db.DB.Exec(`DELETE FROM sessions WHERE expires_at <= datetime('now')`)
+	_, err := db.DB.Exec(
+		`INSERT INTO sessions (id, user_id, ip, user_agent, remember, expires_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		sid, uid, ClientIP(r), ua, remember, expiresAt(sessionTTL(remember)))
+	if err != nil {
+		return err
+	}
+	audit.Log(audit.Event{UserID: uid, Action: "auth.login", IP: ClientIP(r), Details: map[string]any{"remember": remember}})
+	return issueToken(w, uid, sid, remember)
+}
+
+// renewSession выдаёт новый токен доступа и сдвигает срок сессии.
+func renewSession(w http.ResponseWriter, uid int64, sid string, remember bool) error {
+	if _, err := db.DB.Exec(`UPDATE sessions SET expires_at = ? WHERE id = ?`,
+		expiresAt(sessionTTL(remember)), sid); err != nil {
+		return err
+	}
+	return issueToken(w, uid, sid, remember)
+}
+
+func issueToken(w http.ResponseWriter, uid int64, sid string, remember bool) error {
+	tok, err := NewToken(uid, sid, lifetimes.Access)
+	if err != nil {
+		return err
+	}
+	var maxAge time.Duration
+	if remember {
+		maxAge = lifetimes.Remember
+	}
+	SetCookie(w, tok, maxAge)
+	return nil
+}
+
+func expiresAt(ttl time.Duration) string {
+	return time.Now().UTC().Add(ttl).Format("2006-01-02 15:04:05")
+}
+
+// checkSession проверяет, что сессия жива, и отмечает активность не чаще раза в минуту.
+func checkSession(sid string, uid int64) (remember bool, err error) {
+	err = db.DB.QueryRow(
+		`SELECT remember FROM sessions WHERE id = ? AND user_id = ? AND expires_at > datetime('now')`,
+		sid, uid).Scan(&remember)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, ErrSessionRevoked
+	}
+	if err != nil {
+		return false, err
+	}
+	db.DB.Exec(
+		`UPDATE sessions SET last_seen_at = datetime('now')
+		 WHERE id = ? AND last_seen_at < datetime('now', '-1 minute')`, sid)
+	return remember, nil
+}
+
+func ListSessions(uid int64) ([]Session, error) {
+	rows, err := db.DB.Query(
+		`SELECT id, ip, user_agent, created_at, last_seen_at, expires_at FROM sessions
+		 WHERE user_id = ? AND expires_at > datetime('now') ORDER BY last_seen_at DESC`, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Session
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.IP, &s.UserAgent, &s.CreatedAt, &s.LastSeen, &s.ExpiresAt); err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+// RevokeSession завершает сессию sid пользователя uid.
+func RevokeSession(uid int64, sid string) error {
+	res, err := db.DB.Exec(`DELETE FROM sessions WHERE id = ? AND user_id = ?`, sid, uid)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// RevokeUserSessions завершает все сессии пользователя, кроме except.
+func RevokeUserSessions(uid int64, except string) error {
+	_, err := db.DB.Exec(`DELETE FROM sessions WHERE user_id = ? AND id <> ?`, uid, except)
+	return err
+}
+
+// Logout завершает текущую сессию запроса и стирает cookie.
+func Logout(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie("tok"); err == nil {
+		if claims, err := parseSigned(c.Value); err == nil {
+			RevokeSession(claims.UID, claims.ID)
+			audit.Log(audit.Event{UserID: claims.UID, Action: "auth.logout", IP: ClientIP(r)})
+		}
+	}
+	clearCookie(w)
+}
+
+// ClientIP — адрес клиента запроса без порта. За доверенным прокси — первый
+// справа адрес из X-Forwarded-For, не принадлежащий доверенным прокси:
+// левые элементы списка клиент мог подставить сам.
+func ClientIP(r *http.Request) string {
+	ip := peerIP(r)
+	if !trusted(ip) {
+		return ip
+	}
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		h := strings.TrimSpace(hops[i])
+		if net.ParseIP(h) == nil {
+			break
+		}
+		if ip = h; !trusted(h) {
+			break
+		}
+	}
+	return ip
+}
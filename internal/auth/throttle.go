@@ -0,0 +1,232 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/ZenithSolitude/Hopefully/internal/audit"
+	"github.com/ZenithSolitude/Hopefully/internal/db"
+)
+
+// ── Brute-force protection ────────────────────────────────────────────────────
+
+// Ошибки входа считаются отдельно по IP и по логину. После порога каждая
+// следующая ошибка блокирует вход вдвое дольше (с lockBase до lockMax).
+// Счётчик без блокировки забывается через failWindow после последней ошибки.
+const (
+	userThreshold = 5
+	ipThreshold   = 20
+	lockBase      = 30 * time.Second
+	lockMax       = time.Hour
+	failWindow    = time.Hour
+
+	scopeIP   = "ip"
+	scopeUser = "user"
+)
+
+var ErrBadCredentials = errors.New("invalid username or password")
+
+// LockedError — вход временно заблокирован.
+type LockedError struct{ Wait time.Duration }
+
+func (e *LockedError) Error() string { return fmt.Sprintf("login locked for %s", e.Wait) }
+
+type Lockout struct {
+	Scope       string
+	Key         string
+	Failures    int
+	LastFailure string
+	LockedUntil string
+}
+
+func (l Lockout) Locked() bool {
+	t, err := time.Parse(timeFormat, l.LockedUntil)
+	return err == nil && time.Now().UTC().Before(t)
+}
+
+const timeFormat = "2006-01-02 15:04:05"
+
+// dummyHash сравнивается с паролем, когда логина нет, — чтобы ответ
+// занимал столько же времени, сколько для существующего пользователя.
+var dummyHash = sync.OnceValue(func() []byte {
+	h, _ := bcrypt.GenerateFromPassword([]byte("hopefully/no-such-user"), bcrypt.DefaultCost)
+	return h
+})
+
+// Authenticate проверяет логин и пароль с учётом блокировок: локальных
+// пользователей — по хешу в базе, остальных — во внешних источниках.
+// Возвращает *LockedError (в том числе когда блокировку вызвала эта же
+// ошибка), ErrBadCredentials, ErrAuthUnavailable или пользователя.
+func Authenticate(r *http.Request, username, password string) (*User, error) {
+	ip := ClientIP(r)
+	username = strings.TrimSpace(username)
+	if wait := lockedFor(ip, username); wait > 0 {
+		return nil, &LockedError{Wait: wait}
+	}
+	u, hash, err := GetByUsername(username)
+	switch {
+	case errors.Is(err, sql.ErrNoRows) && len(authenticators) > 0:
+		u, err = authenticateExternal(r.Context(), username, password, "")
+	case errors.Is(err, sql.ErrNoRows):
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		u, err = nil, ErrBadCredentials
+	case err != nil:
+		return nil, err
+	case u.ExternalSource():
+		var ext *User
+		if ext, err = authenticateExternal(r.Context(), username, password, u.AuthSource); err == nil {
+			u = ext
+		}
+	case !CheckPassword(hash, password):
+		err = ErrBadCredentials
+	}
+	if err == nil && !u.IsActive {
+		err = ErrBadCredentials
+	}
+	if errors.Is(err, ErrBadCredentials) {
+		wait := recordFailure(ip, username)
+		e := audit.Event{Actor: truncate(username, 64), Action: "auth.login_failed", IP: ip}
+		if u != nil {
+			e.UserID = u.ID
+		}
+		audit.Log(e)
+		if wait > 0 {
+			return nil, &LockedError{Wait: wait}
+		}
+		return nil, ErrBadCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	clearFailures(scopeUser, username)
+	return u, nil
+}
+
+// lockedFor — сколько ещё заблокирован вход для ip или username.
+func lockedFor(ip, username string) time.Duration {
+	var wait time.Duration
+	rows, err := db.DB.Query(
+		`SELECT locked_until FROM login_failures
+		 WHERE ((scope = ? AND key = ?) OR (scope = ? AND key = ?)) AND locked_until > datetime('now')`,
+		scopeIP, ip, scopeUser, username)
+	if err != nil {
+		return 0
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var until string
+		rows.Scan(&until)
+		if t, err := time.Parse(timeFormat, until); err == nil {
+			if d := time.Until(t); d > wait {
+				wait = d
+			}
+		}
+	}
+	return wait
+}
+
+// recordFailure засчитывает ошибку входа ip и username и возвращает, на
+// сколько после неё заблокирован вход (0 — не заблокирован).
+func recordFailure(ip, username string) time.Duration {
+	wait := bump(scopeIP, ip, ipThreshold)
+	if username != "" {
+		wait = max(wait, bump(scopeUser, username, userThreshold))
+	}
+	return wait
+}
+
+// bumpSQL одним UPSERT увеличивает счётчик (или начинает его заново после
+// failWindow) и с порога ставит блокировку lockBase << (failures-threshold),
+// не дольше lockMax. Новое значение счётчика в SET не видно, поэтому оно
+// считается во вложенном SELECT. ?1 — scope, ?2 — key, ?3 — порог,
+// ?4 — окно, ?5 и ?6 — lockBase и lockMax в секундах.
+const bumpSQL = `
+INSERT INTO login_failures (scope, key, failures, last_failure, locked_until)
+VALUES (?1, ?2, 1, datetime('now'), CASE WHEN ?3 <= 1 THEN datetime('now', '+' || ?5 || ' seconds') END)
+ON CONFLICT(scope, key) DO UPDATE SET
+	(failures, last_failure, locked_until) = (
+		SELECT f, datetime('now'), CASE WHEN f >= ?3
+			THEN datetime('now', '+' || min(?5 << min(f - ?3, 7), ?6) || ' seconds')
+			ELSE login_failures.locked_until END
+		FROM (SELECT CASE WHEN login_failures.last_failure < datetime('now', ?4)
+			THEN 1 ELSE login_failures.failures + 1 END AS f))
+RETURNING failures, last_failure, COALESCE(locked_until, '')`
+
+// bump засчитывает ошибку по ключу и возвращает, на сколько он теперь
+// заблокирован. Счётчик и блокировка меняются одним запросом, а решение
+// о блокировке принимается по вернувшейся строке — параллельные ошибки
+// не теряются и не перетирают друг другу счётчик.
+func bump(scope, key string, threshold int) time.Duration {
+	var failures int
+	var last, until string
+	err := db.DB.QueryRow(bumpSQL, scope, key, threshold,
+		fmt.Sprintf("-%d seconds", int(failWindow.Seconds())),
+		int(lockBase.Seconds()), int(lockMax.Seconds())).Scan(&failures, &last, &until)
+	if err != nil {
+		log.Printf("auth: login failures: %v", err)
+		return 0
+	}
+	if failures < threshold {
+		return 0
+	}
+	l, err1 := time.Parse(timeFormat, last)
+	u, err2 := time.Parse(timeFormat, until)
+	if err1 != nil || err2 != nil {
+		return 0
+	}
+	lock := u.Sub(l)
+	log.Printf("auth: locked %s %q for %s after %d failed logins", scope, key, lock, failures)
+	audit.Log(audit.Event{Action: "auth.lockout", Target: scope + ":" + key,
+		Details: map[string]any{"failures": failures, "seconds": int(lock.Seconds())}})
+	return max(time.Until(u), time.Second)
+}
+
+func truncate(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n])
+	}
+	return s
+}
+
+func clearFailures(scope, key string) {
+	db.DB.Exec(`DELETE FROM login_failures WHERE scope = ? AND key = ?`, scope, key)
+}
+
+// ListLockouts — текущие блокировки и недавние ошибки входа, для администратора.
+func ListLockouts() ([]Lockout, error) {
+	rows, err := db.DB.Query(
+		`SELECT scope, key, failures, last_failure, COALESCE(locked_until,'') FROM login_failures
+		 WHERE locked_until > datetime('now') OR last_failure > datetime('now', ?)
+		 ORDER BY last_failure DESC`, fmt.Sprintf("-%d seconds", int(failWindow.Seconds())))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Lockout
+	for rows.Next() {
+		var l Lockout
+		if err := rows.Scan(&l.Scope, &l.Key, &l.Failures, &l.LastFailure, &l.LockedUntil); err != nil {
+			return nil, err
+		}
+		out = append(out, l)
+	}
+	return out, rows.Err()
+}
+
+// Unlock снимает блокировку и обнуляет счётчик ошибок.
+func Unlock(scope, key string) error {
+	if scope != scopeIP && scope != scopeUser {
+		return fmt.Errorf("unknown scope %q", scope)
+	}
+	clearFailures(scope, key)
+	log.Printf("auth: unlocked %s %q", scope, key)
+	return nil
+}
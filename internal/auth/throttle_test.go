@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ZenithSolitude/Hopefully/internal/db"
+)
+
+// lockFor — на сколько заблокирован ключ после последней ошибки.
+func lockFor(t *testing.T, scope, key string) time.Duration {
+	t.Helper()
+	var last, until string
+	err := db.DB.QueryRow(`SELECT last_failure, COALESCE(locked_until,'') FROM login_failures WHERE scope = ? AND key = ?`,
+		scope, key).Scan(&last, &until)
+	if err != nil || until == "" {
+		return 0
+	}
+	l, _ := time.Parse(timeFormat, last)
+	u, _ := time.Parse(timeFormat, until)
+	return u.Sub(l)
+}
+
+func TestThrottleEscalation(t *testing.T) {
+	setupDB(t)
+	tests := []struct {
+		failures int
+		lock     time.Duration
+	}{
+		{1, 0},
+		{userThreshold - 1, 0},
+		{userThreshold, lockBase},
+		{userThreshold + 1, 2 * lockBase},
+		{userThreshold + 2, 4 * lockBase},
+		{userThreshold + 6, 64 * lockBase},
+		{userThreshold + 7, lockMax}, // 128 × 30 с больше часа
+		{userThreshold + 20, lockMax},
+	}
+	n := 0
+	for _, tt := range tests {
+		for ; n < tt.failures; n++ {
+			bump(scopeUser, "bob", userThreshold)
+		}
+		if got := lockFor(t, scopeUser, "bob"); got != tt.lock {
+			t.Errorf("after %d failures: lock %s, want %s", tt.failures, got, tt.lock)
+		}
+	}
+}
+
+func TestThrottleWindowReset(t *testing.T) {
+	setupDB(t)
+	for i := 0; i < userThreshold-1; i++ {
+		bump(scopeUser, "bob", userThreshold)
+	}
+	old := time.Now().UTC().Add(-failWindow - time.Minute).Format(timeFormat)
+	db.DB.Exec(`UPDATE login_failures SET last_failure = ? WHERE key = 'bob'`, old)
+	bump(scopeUser, "bob", userThreshold)
+	var failures int
+	db.DB.QueryRow(`SELECT failures FROM login_failures WHERE key = 'bob'`).Scan(&failures)
+	if failures != 1 || lockFor(t, scopeUser, "bob") != 0 {
+		t.Fatalf("failures = %d after the window, want 1 and no lock", failures)
+	}
+}
+
+// Параллельные ошибки не теряются: каждая видит свой номер, и ровно одна
+// из них — пороговая.
+func TestThrottleConcurrent(t *testing.T) {
+	setupDB(t)
+	const n = 3 * userThreshold
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	waits := make(chan time.Duration, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			waits <- bump(scopeUser, "bob", userThreshold)
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(waits)
+	locked := 0
+	for w := range waits {
+		if w > 0 {
+			locked++
+		}
+	}
+	var failures int
+	db.DB.QueryRow(`SELECT failures FROM login_failures WHERE key = 'bob'`).Scan(&failures)
+	if failures != n || locked != n-userThreshold+1 {
+		t.Fatalf("failures = %d, locked = %d; want %d and %d", failures, locked, n, n-userThreshold+1)
+	}
+}
+
+func TestAuthenticateLockout(t *testing.T) {
+	setupDB(t)
+	addUser(t, "bob", UserRole)
+	try := func(password string) error {
+		r := httptest.NewRequest(http.MethodPost, "/login", nil)
+		r.RemoteAddr = "192.0.2.7:5000"
+		_, err := Authenticate(r, "bob", password)
+		return err
+	}
+	for i := 0; i < userThreshold-1; i++ {
+		if err := try("wrong"); !errors.Is(err, ErrBadCredentials) {
+			t.Fatalf("attempt %d: err = %v", i+1, err)
+		}
+	}
+	var locked *LockedError
+	if err := try("wrong"); !errors.As(err, &locked) {
+		t.Fatalf("attempt %d: err = %v, want LockedError", userThreshold, err)
+	}
+	if err := try("Correct-Horse-42"); !errors.As(err, &locked) {
+		t.Fatalf("correct password while locked: err = %v, want LockedError", err)
+	}
+	if locked.Wait <= 0 || locked.Wait > lockBase {
+		t.Fatalf("wait = %s", locked.Wait)
+	}
+	if err := Unlock(scopeUser, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := try("Correct-Horse-42"); err != nil {
+		t.Fatalf("after unlock: %v", err)
+	}
+}
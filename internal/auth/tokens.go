@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ZenithSolitude/Hopefully/internal/db"
+)
+
+// ── API tokens ────────────────────────────────────────────────────────────────
+
+// APITokenPrefix отличает личные токены от JWT сессии в Authorization: Bearer.
+const APITokenPrefix = "hf_"
+
+var (
+	ErrTokenInvalid    = errors.New("invalid or expired API token")
+	ErrTokenViaToken   = errors.New("API tokens cannot be created with an API token")
+	ErrScopeNotGranted = errors.New("scope exceeds your permissions")
+)
+
+type APIToken struct {
+	ID        int64
+	Name      string
+	Prefix    string // начало токена — чтобы узнать его в списке
+	Scopes    []string
+	CreatedAt string
+	ExpiresAt string // пусто — бессрочный
+	LastUsed  string
+}
+
+func (t APIToken) Expired() bool {
+	if t.ExpiresAt == "" {
+		return false
+	}
+	exp, err := time.Parse("2006-01-02 15:04:05", t.ExpiresAt)
+	return err == nil && time.Now().UTC().After(exp)
+}
+
+func hashToken(plain string) string {
+	sum := sha256.Sum256([]byte(plain))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIToken выпускает токен пользователю u. Scopes не шире его прав,
+// а запрос с API-токеном нового токена не получит: иначе узкий токен
+// выпускал бы себе "*". Открытое значение возвращается только здесь — в БД
+// хранится его SHA-256. ttl = 0 — бессрочный токен.
+func CreateAPIToken(u *User, name string, scopes []string, ttl time.Duration) (string, error) {
+	if u.ViaAPIToken() {
+		return "", ErrTokenViaToken
+	}
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", errors.New("token name is required")
+	}
+	if len(scopes) == 0 {
+		return "", errors.New("at least one scope is required")
+	}
+	if err := validatePermissions(scopes); err != nil {
+		return "", err
+	}
+	for _, sc := range scopes {
+		if !HasPermission(u.Permissions, sc) {
+			return "", fmt.Errorf("%w: %s", ErrScopeNotGranted, sc)
+		}
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	plain := APITokenPrefix + hex.EncodeToString(b)
+	var expires any
+	if ttl > 0 {
+		expires = time.Now().UTC().Add(ttl).Format("2006-01-02 15:04:05")
+	}
+	sj, _ := json.Marshal(scopes)
+	_, err := db.DB.Exec(
+		`INSERT INTO api_tokens (user_id, name, token_hash, prefix, scopes, expires_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		u.ID, name, hashToken(plain), plain[:len(APITokenPrefix)+8], string(sj), expires)
+	if err != nil {
+		return "", err
+	}
+	return plain, nil
+}
+
+func ListAPITokens(uid int64) ([]APIToken, error) {
+	rows, err := db.DB.Query(
+		`SELECT id, name, prefix, scopes, created_at, COALESCE(expires_at,''), COALESCE(last_used_at,'')
+		 FROM api_tokens WHERE user_id = ? ORDER BY id DESC`, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []APIToken
+	for rows.Next() {
+		var t APIToken
+		var sj string
+		if err := rows.Scan(&t.ID, &t.Name, &t.Prefix, &sj, &t.CreatedAt, &t.ExpiresAt, &t.LastUsed); err != nil {
+			return nil, err
+		}
+		json.Unmarshal([]byte(sj), &t.Scopes)
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+// RevokeAPIToken удаляет токен пользователя uid.
+func RevokeAPIToken(uid, id int64) error {
+	res, err := db.DB.Exec(`DELETE FROM api_tokens WHERE id = ? AND user_id = ?`, id, uid)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// lookupAPIToken находит владельца и scopes токена и отмечает использование
+// (не чаще раза в минуту, чтобы не писать в БД на каждый запрос).
+func lookupAPIToken(plain string) (int64, []string, error) {
+	var id, uid int64
+	var sj string
+	err := db.DB.QueryRow(
+		`SELECT id, user_id, scopes FROM api_tokens
+		 WHERE token_hash = ? AND (expires_at IS NULL OR expires_at > datetime('now'))`,
+		hashToken(plain)).Scan(&id, &uid, &sj)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil, ErrTokenInvalid
+	}
+	if err != nil {
+		return 0, nil, fmt.Errorf("api token: %w", err)
+	}
+	var scopes []string
+	json.Unmarshal([]byte(sj), &scopes)
+	db.DB.Exec(
+		`UPDATE api_tokens SET last_used_at = datetime('now')
+		 WHERE id = ? AND (last_used_at IS NULL OR last_used_at < datetime('now', '-1 minute'))`, id)
+	return uid, scopes, nil
+}
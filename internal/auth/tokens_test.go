@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCreateAPITokenScopes(t *testing.T) {
+	setupDB(t)
+	admin := addUser(t, "root", AdminRole)
+	user := addUser(t, "bob", UserRole) // dashboard.view, modules.view
+
+	tests := []struct {
+		name   string
+		u      *User
+		scopes []string
+		err    error
+	}{
+		{"own permission", user, []string{"modules.view"}, nil},
+		{"all own permissions", user, []string{"dashboard.view", "modules.view"}, nil},
+		{"beyond role", user, []string{"users.manage"}, ErrScopeNotGranted},
+		{"wildcard beyond role", user, []string{"*"}, ErrScopeNotGranted},
+		{"mask beyond role", user, []string{"modules.*"}, ErrScopeNotGranted},
+		{"admin wildcard", admin, []string{"*"}, nil},
+		{"admin mask", admin, []string{"modules.*"}, nil},
+	}
+	for _, tt := range tests {
+		_, err := CreateAPIToken(tt.u, "ci", tt.scopes, 0)
+		if (tt.err == nil && err != nil) || (tt.err != nil && !errors.Is(err, tt.err)) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+// Запрос с узким API-токеном не выпускает себе новый токен, даже в пределах
+// прав владельца.
+func TestCreateAPITokenViaToken(t *testing.T) {
+	setupDB(t)
+	admin := addUser(t, "root", AdminRole)
+	narrow, err := CreateAPIToken(admin, "read-only", []string{"modules.view"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got error
+	h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, got = CreateAPIToken(CtxGet(r), "escalate", []string{"*"}, 0)
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/profile/tokens", nil)
+	req.Header.Set("Authorization", "Bearer "+narrow)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if !errors.Is(got, ErrTokenViaToken) {
+		t.Fatalf("err = %v, want ErrTokenViaToken", got)
+	}
+	tokens, _ := ListAPITokens(admin.ID)
+	if len(tokens) != 1 {
+		t.Fatalf("%d tokens, want 1", len(tokens))
+	}
+}
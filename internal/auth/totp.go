@@ -0,0 +1,356 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"rsc.io/qr"
+
+	"github.com/ZenithSolitude/Hopefully/internal/audit"
+	"github.com/ZenithSolitude/Hopefully/internal/db"
+)
+
+// ── TOTP (RFC 6238) ───────────────────────────────────────────────────────────
+
+const (
+	totpPeriod    = 30
+	totpDigits    = 6
+	totpSkew      = 1 // допускаем код соседнего 30-секундного окна
+	recoveryCount = 10
+	issuer        = "Hopefully"
+
+	// SettingRequireAdmin2FA — настройка «администраторам обязательна 2FA».
+	SettingRequireAdmin2FA = "require_admin_2fa"
+)
+
+var (
+	ErrBadCode   = errors.New("invalid code")
+	ErrNoPending = errors.New("no pending two-factor login")
+	b32          = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// totpCode — код HOTP (RFC 4226) для шага counter.
+func totpCode(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, v%1000000)
+}
+
+// matchTOTP ищет шаг, для которого code верен, среди окон вокруг t.
+// Шаги не новее last не принимаются — код нельзя использовать дважды.
+func matchTOTP(secret []byte, code string, t time.Time, last int64) (int64, bool) {
+	now := t.Unix() / totpPeriod
+	for d := int64(-totpSkew); d <= totpSkew; d++ {
+		step := now + d
+		if step <= last {
+			continue
+		}
+		if hmac.Equal([]byte(totpCode(secret, uint64(step))), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// StartTOTPSetup выдаёт пользователю новый секрет (ещё не включённый)
+// и otpauth:// URI для приложения-аутентификатора.
+func StartTOTPSetup(uid int64, username string) (secret, uri string, err error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	secret = b32.EncodeToString(b)
+	if _, err := db.DB.Exec(`UPDATE users SET totp_secret = ?, totp_enabled = 0 WHERE id = ?`, secret, uid); err != nil {
+		return "", "", err
+	}
+	q := url.Values{"secret": {secret}, "issuer": {issuer}, "algorithm": {"SHA1"},
+		"digits": {fmt.Sprint(totpDigits)}, "period": {fmt.Sprint(totpPeriod)}}
+	uri = "otpauth://totp/" + url.PathEscape(issuer+":"+username) + "?" + q.Encode()
+	return secret, uri, nil
+}
+
+// QRDataURI рисует QR-код строки s как PNG в data: URI.
+func QRDataURI(s string) (string, error) {
+	c, err := qr.Encode(s, qr.M)
+	if err != nil {
+		return "", err
+	}
+	c.Scale = 6
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(c.PNG()), nil
+}
+
+// checkTOTP сверяет код с секретом пользователя и запоминает использованный шаг.
+func checkTOTP(uid int64, code string) error {
+	var secret string
+	var last int64
+	if err := db.DB.QueryRow(`SELECT totp_secret, totp_last_step FROM users WHERE id = ?`, uid).
+		Scan(&secret, &last); err != nil {
+		return err
+	}
+	key, err := b32.DecodeString(secret)
+	if err != nil || secret == "" {
+		return ErrBadCode
+	}
+	step, ok := matchTOTP(key, strings.TrimSpace(code), time.Now(), last)
+	if !ok {
+		return ErrBadCode
+	}
+	// Шаг занимается условно: из двух параллельных запросов с одним кодом
+	// пройдёт только тот, что обновит строку первым.
+	res, err := db.DB.Exec(`UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?`, step, uid, step)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return ErrBadCode
+	}
+	return nil
+}
+
+// EnableTOTP включает 2FA, если code подходит к секрету из StartTOTPSetup,
+// и возвращает новые коды восстановления.
+func EnableTOTP(uid int64, code string) ([]string, error) {
+	if err := checkTOTP(uid, code); err != nil {
+		return nil, err
+	}
+	if _, err := db.DB.Exec(`UPDATE users SET totp_enabled = 1 WHERE id = ?`, uid); err != nil {
+		return nil, err
+	}
+	return RegenerateRecoveryCodes(uid)
+}
+
+// DisableTOTP выключает 2FA и удаляет коды восстановления.
+func DisableTOTP(uid int64) error {
+	if _, err := db.DB.Exec(
+		`UPDATE users SET totp_enabled = 0, totp_secret = '', totp_last_step = 0 WHERE id = ?`, uid); err != nil {
+		return err
+	}
+	_, err := db.DB.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, uid)
+	return err
+}
+
+// ── Recovery codes ────────────────────────────────────────────────────────────
+
+// RegenerateRecoveryCodes заменяет коды восстановления пользователя новыми.
+// Открытые значения возвращаются только здесь.
+func RegenerateRecoveryCodes(uid int64) ([]string, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, uid); err != nil {
+		return nil, err
+	}
+	codes := make([]string, recoveryCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		c := strings.ToLower(b32.EncodeToString(b))
+		codes[i] = c[:4] + "-" + c[4:]
+		if _, err := tx.Exec(`INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)`,
+			uid, hashToken(codes[i])); err != nil {
+			return nil, err
+		}
+	}
+	return codes, tx.Commit()
+}
+
+func RecoveryCodesLeft(uid int64) int {
+	var n int
+	db.DB.QueryRow(`SELECT COUNT(*) FROM recovery_codes WHERE user_id = ?`, uid).Scan(&n)
+	return n
+}
+
+// useRecoveryCode гасит код восстановления, если он есть у пользователя.
+func useRecoveryCode(uid int64, code string) error {
+	res, err := db.DB.Exec(`DELETE FROM recovery_codes WHERE user_id = ? AND code_hash = ?`,
+		uid, hashToken(strings.ToLower(strings.TrimSpace(code))))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrBadCode
+	}
+	return nil
+}
+
+// VerifySecondFactor принимает код из приложения или код восстановления.
+func VerifySecondFactor(uid int64, code string) error {
+	code = strings.TrimSpace(code)
+	if len(code) == totpDigits {
+		return checkTOTP(uid, code)
+	}
+	return useRecoveryCode(uid, code)
+}
+
+// TwoFactorRequired — должен ли пользователь включить 2FA, прежде чем работать.
+func TwoFactorRequired(u *User) bool {
+	return u.IsAdmin && !u.TOTPEnabled && db.Setting(SettingRequireAdmin2FA) == "1"
+}
+
+// ── Second login step ─────────────────────────────────────────────────────────
+
+// Между паролем и кодом пользователь держит cookie "mfa" — короткий JWT
+// с aud "mfa". Он не годится как токен сессии: у него нет jti.
+
+const (
+	mfaCookie      = "mfa"
+	mfaTTL         = 5 * time.Minute
+	mfaMaxAttempts = 5
+)
+
+type mfaClaims struct {
+	UID      int64 `json:"uid"`
+	Remember bool  `json:"rem,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// mfaFails — неудачные попытки по nonce (Subject) отложенного входа. Nonce,
+// который исчерпал попытки или уже открыл сессию, остаётся здесь с
+// mfaMaxAttempts до истечения своей cookie: повтор той же cookie отклоняется.
+var (
+	mfaMu    sync.Mutex
+	mfaFails = map[string]int{}
+	mfaSeen  = map[string]time.Time{} // когда истекает nonce — чтобы чистить map
+)
+
+// mfaFail увеличивает счётчик ошибок nonce и говорит, исчерпан ли лимит.
+func mfaFail(nonce string, exp time.Time) bool {
+	mfaMu.Lock()
+	defer mfaMu.Unlock()
+	mfaPrune()
+	mfaSeen[nonce] = exp
+	mfaFails[nonce]++
+	return mfaFails[nonce] >= mfaMaxAttempts
+}
+
+// mfaRetire помечает nonce использованным до exp.
+func mfaRetire(nonce string, exp time.Time) {
+	mfaMu.Lock()
+	defer mfaMu.Unlock()
+	mfaPrune()
+	mfaSeen[nonce] = exp
+	mfaFails[nonce] = mfaMaxAttempts
+}
+
+// mfaPrune забывает истёкшие nonce. Вызывается под mfaMu.
+func mfaPrune() {
+	for n, t := range mfaSeen {
+		if time.Now().After(t) {
+			delete(mfaSeen, n)
+			delete(mfaFails, n)
+		}
+	}
+}
+
+func mfaLocked(nonce string) bool {
+	mfaMu.Lock()
+	defer mfaMu.Unlock()
+	return mfaFails[nonce] >= mfaMaxAttempts
+}
+
+// BeginSecondFactor запоминает, что пароль пользователя уже проверен.
+func BeginSecondFactor(w http.ResponseWriter, uid int64, remember bool) error {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	c := mfaClaims{UID: uid, Remember: remember, RegisteredClaims: jwt.RegisteredClaims{
+		Subject:   b32.EncodeToString(b),
+		Audience:  jwt.ClaimStrings{mfaCookie},
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(mfaTTL)),
+	}}
+	tok, err := sign(c)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{Name: mfaCookie, Value: tok, Path: "/login", HttpOnly: true,
+		SameSite: http.SameSiteLaxMode, MaxAge: int(mfaTTL.Seconds())})
+	return nil
+}
+
+func pendingSecondFactor(r *http.Request) (*mfaClaims, error) {
+	ck, err := r.Cookie(mfaCookie)
+	if err != nil {
+		return nil, ErrNoPending
+	}
+	c := &mfaClaims{}
+	_, err = jwt.ParseWithClaims(ck.Value, c, verifyKey, jwt.WithAudience(mfaCookie), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, ErrNoPending
+	}
+	return c, nil
+}
+
+// HasPendingSecondFactor — ждёт ли запрос ввода второго фактора.
+func HasPendingSecondFactor(r *http.Request) bool {
+	_, err := pendingSecondFactor(r)
+	return err == nil
+}
+
+// FinishSecondFactor проверяет код для отложенного входа и при успехе
+// открывает сессию. После mfaMaxAttempts ошибок нужно заново ввести пароль.
+func FinishSecondFactor(w http.ResponseWriter, r *http.Request, code string) (int64, error) {
+	c, err := pendingSecondFactor(r)
+	if err != nil {
+		return 0, err
+	}
+	if mfaLocked(c.Subject) {
+		clearSecondFactor(w, c)
+		return 0, ErrNoPending
+	}
+	u, err := GetByID(c.UID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !u.IsActive) {
+		clearSecondFactor(w, c)
+		return 0, ErrNoPending
+	}
+	if err != nil {
+		return 0, err
+	}
+	ip := ClientIP(r)
+	if wait := lockedFor(ip, u.Username); wait > 0 {
+		return 0, &LockedError{Wait: wait}
+	}
+	if err := VerifySecondFactor(c.UID, code); err != nil {
+		wait := recordFailure(ip, u.Username)
+		audit.Log(audit.Event{UserID: u.ID, Actor: u.Username, Action: "auth.2fa_failed", IP: ip})
+		if mfaFail(c.Subject, c.ExpiresAt.Time) {
+			clearSecondFactor(w, c)
+			return 0, ErrNoPending
+		}
+		if wait > 0 {
+			return 0, &LockedError{Wait: wait}
+		}
+		return 0, err
+	}
+	clearSecondFactor(w, c)
+	return c.UID, StartSession(w, r, c.UID, c.Remember)
+}
+
+// clearSecondFactor завершает отложенный вход: cookie удаляется, а её nonce
+// больше не принимается, даже если cookie прислать повторно.
+func clearSecondFactor(w http.ResponseWriter, c *mfaClaims) {
+	mfaRetire(c.Subject, c.ExpiresAt.Time)
+	http.SetCookie(w, &http.Cookie{Name: mfaCookie, Path: "/login", MaxAge: -1})
+}
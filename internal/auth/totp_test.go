@@ -0,0 +1,179 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ZenithSolitude/Hopefully/internal/db"
+)
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	// Вектор из приложения B RFC 6238 (SHA-1), последние 6 цифр
+	secret := []byte("12345678901234567890")
+	if got := totpCode(secret, uint64(59/totpPeriod)); got != "287082" {
+		t.Fatalf("code = %s, want 287082", got)
+	}
+}
+
+func TestMatchTOTPStepReuse(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1_700_000_000, 0)
+	step := now.Unix() / totpPeriod
+	code := func(s int64) string { return totpCode(secret, uint64(s)) }
+
+	tests := []struct {
+		name string
+		code string
+		last int64
+		step int64
+		ok   bool
+	}{
+		{"current step", code(step), 0, step, true},
+		{"previous window", code(step - 1), 0, step - 1, true},
+		{"next window", code(step + 1), 0, step + 1, true},
+		{"outside skew", code(step - 2), 0, 0, false},
+		{"current step reused", code(step), step, 0, false},
+		{"older step after newer used", code(step - 1), step, 0, false},
+		{"newer step after older used", code(step + 1), step, step + 1, true},
+		{"wrong code", "000000", 0, 0, code(step) == "000000"},
+	}
+	for _, tt := range tests {
+		got, ok := matchTOTP(secret, tt.code, now, tt.last)
+		if ok != tt.ok || (ok && got != tt.step) {
+			t.Errorf("%s: matchTOTP = %d, %v; want %d, %v", tt.name, got, ok, tt.step, tt.ok)
+		}
+	}
+}
+
+// Код, уже принятый один раз, второй раз не проходит — даже в своём окне.
+func TestCheckTOTPReplay(t *testing.T) {
+	setupDB(t)
+	u := addUser(t, "bob", UserRole)
+	secret, _, err := StartTOTPSetup(u.ID, u.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := b32.DecodeString(secret)
+	code := totpCode(key, uint64(time.Now().Unix()/totpPeriod))
+	if _, err := EnableTOTP(u.ID, code); err != nil {
+		t.Fatalf("enable: %v", err)
+	}
+	if err := VerifySecondFactor(u.ID, code); !errors.Is(err, ErrBadCode) {
+		t.Fatalf("replayed code: err = %v, want ErrBadCode", err)
+	}
+	var last int64
+	db.DB.QueryRow(`SELECT totp_last_step FROM users WHERE id = ?`, u.ID).Scan(&last)
+	if last == 0 {
+		t.Fatal("used step not recorded")
+	}
+}
+
+func TestRecoveryCodeSingleUse(t *testing.T) {
+	setupDB(t)
+	u := addUser(t, "bob", UserRole)
+	codes, err := RegenerateRecoveryCodes(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifySecondFactor(u.ID, " "+codes[0]+" "); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if err := VerifySecondFactor(u.ID, codes[0]); !errors.Is(err, ErrBadCode) {
+		t.Fatalf("second use: err = %v, want ErrBadCode", err)
+	}
+	if n := RecoveryCodesLeft(u.ID); n != recoveryCount-1 {
+		t.Fatalf("%d codes left, want %d", n, recoveryCount-1)
+	}
+}
+
+// Два запроса с одним кодом одновременно: проходит ровно один.
+func TestCheckTOTPConcurrent(t *testing.T) {
+	setupDB(t)
+	u := addUser(t, "bob", UserRole)
+	secret, _, err := StartTOTPSetup(u.ID, u.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := b32.DecodeString(secret)
+	code := totpCode(key, uint64(time.Now().Unix()/totpPeriod))
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	passed := 0
+	start := make(chan struct{})
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if checkTOTP(u.ID, code) == nil {
+				mu.Lock()
+				passed++
+				mu.Unlock()
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if passed != 1 {
+		t.Fatalf("code accepted %d times", passed)
+	}
+}
+
+// Cookie второго шага, исчерпавшая попытки или уже открывшая сессию, не
+// принимается повторно, пока не истечёт, — даже с верным кодом.
+func TestSecondFactorCookieReplay(t *testing.T) {
+	setupDB(t)
+	u := addUser(t, "bob", UserRole)
+	codes, err := RegenerateRecoveryCodes(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	begin := func() *http.Cookie {
+		rec := httptest.NewRecorder()
+		if err := BeginSecondFactor(rec, u.ID, false); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Result().Cookies()[0]
+	}
+	finish := func(ck *http.Cookie, code string) error {
+		req := httptest.NewRequest(http.MethodPost, "/login/2fa", nil)
+		req.AddCookie(ck)
+		_, err := FinishSecondFactor(httptest.NewRecorder(), req, code)
+		// Блокировку по логину и IP снимаем: проверяем именно cookie
+		clearFailures(scopeUser, u.Username)
+		clearFailures(scopeIP, ClientIP(req))
+		return err
+	}
+
+	locked := begin()
+	for i := 1; i < mfaMaxAttempts; i++ {
+		if err := finish(locked, "000000"); !errors.Is(err, ErrBadCode) {
+			t.Fatalf("attempt %d: err = %v", i, err)
+		}
+	}
+	if err := finish(locked, "000000"); !errors.Is(err, ErrNoPending) {
+		t.Fatalf("last attempt: err = %v, want ErrNoPending", err)
+	}
+	if err := finish(locked, codes[0]); !errors.Is(err, ErrNoPending) {
+		t.Fatalf("replay after lockout: err = %v, want ErrNoPending", err)
+	}
+
+	used := begin()
+	if err := finish(used, codes[1]); err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if err := finish(used, codes[2]); !errors.Is(err, ErrNoPending) {
+		t.Fatalf("replay after login: err = %v, want ErrNoPending", err)
+	}
+	if n := RecoveryCodesLeft(u.ID); n != recoveryCount-1 {
+		t.Fatalf("%d recovery codes left, want %d", n, recoveryCount-1)
+	}
+
+	if err := finish(begin(), codes[2]); err != nil {
+		t.Fatalf("fresh cookie: %v", err)
+	}
+}
@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/ZenithSolitude/Hopefully/internal/db"
+)
+
+// ── User management ───────────────────────────────────────────────────────────
+
+var (
+	ErrLastAdmin     = errors.New("at least one active administrator must remain")
+	ErrUsernameTaken = errors.New("username is already taken")
+	ErrAdminTarget   = errors.New("only an administrator may change another administrator's account")
+	ErrExternalLogin = errors.New("username of an external account is managed by its directory")
+)
+
+// CheckManageUser — может ли actor изменить пользователя uid: данные,
+// пароль, 2FA, сеансы, включить, отключить или удалить его. Пользователя с
+// roles.manage (администратора в том числе) — только тот, у кого это право
+// есть и самого: иначе users.manage хватало бы, чтобы перехватить его
+// учётку и права.
+func CheckManageUser(actor *User, uid int64) error {
+	if actor.Can("roles.manage") {
+		return nil
+	}
+	target := &User{ID: uid}
+	if err := loadRoles(target); err != nil {
+		return err
+	}
+	if HasPermission(target.Permissions, "roles.manage") {
+		return ErrAdminTarget
+	}
+	return nil
+}
+
+// CreateUser заводит локального пользователя с ролями roleIDs. Запись и роли
+// пишутся одной транзакцией: при ошибке не остаётся пользователя без ролей.
+func CreateUser(username, password, fullName, email string, roleIDs []int64) (int64, error) {
+	if len(roleIDs) == 0 {
+		return 0, ErrNoRoles
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var taken bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE username = ?)`, username).Scan(&taken); err != nil {
+		return 0, err
+	}
+	if taken {
+		return 0, ErrUsernameTaken
+	}
+	res, err := tx.Exec(`INSERT INTO users (username, password, full_name, email) VALUES (?, ?, ?, ?)`,
+		username, hash, fullName, email)
+	if err != nil {
+		return 0, err
+	}
+	uid, _ := res.LastInsertId()
+	if err := addUserRoles(tx, uid, roleIDs); err != nil {
+		return 0, err
+	}
+	return uid, tx.Commit()
+}
+
+// UpdateUser меняет логин, полное имя и email пользователя, а если roleIDs
+// не nil — и его роли, всё одной транзакцией. Логин пользователя внешнего
+// источника не меняется: по нему источник находит учётную запись.
+func UpdateUser(uid int64, username, fullName, email string, roleIDs []int64) error {
+	if roleIDs != nil && len(roleIDs) == 0 {
+		return ErrNoRoles
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var current, source string
+	if err := tx.QueryRow(`SELECT username, auth_source FROM users WHERE id = ?`, uid).Scan(&current, &source); err != nil {
+		return err
+	}
+	if username != current {
+		if (&User{AuthSource: source}).ExternalSource() {
+			return ErrExternalLogin
+		}
+		var taken bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE username = ? AND id <> ?)`, username, uid).Scan(&taken); err != nil {
+			return err
+		}
+		if taken {
+			return ErrUsernameTaken
+		}
+	}
+	if _, err := tx.Exec(`UPDATE users SET username = ?, full_name = ?, email = ? WHERE id = ?`, username, fullName, email, uid); err != nil {
+		return err
+	}
+	if roleIDs != nil {
+		if err := replaceUserRoles(tx, uid, roleIDs); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ToggleUserActive включает или отключает пользователя. У отключённого
+// завершаются все сеансы.
+func ToggleUserActive(uid int64) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var active bool
+	if err := tx.QueryRow(`UPDATE users SET is_active = NOT is_active WHERE id = ? RETURNING is_active`, uid).Scan(&active); err != nil {
+		return err
+	}
+	if err := ensureActiveAdmin(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if !active {
+		return RevokeUserSessions(uid, "")
+	}
+	return nil
+}
+
+// DeleteUser удаляет пользователя вместе с его сеансами, токенами и ролями.
+func DeleteUser(uid int64) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM users WHERE id = ?`, uid); err != nil {
+		return err
+	}
+	if err := ensureActiveAdmin(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ensureActiveAdmin не даёт закоммитить изменение, после которого в портале
+// не останется ни одного активного администратора.
+func ensureActiveAdmin(tx *sql.Tx) error {
+	var ok bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE is_admin = 1 AND is_active = 1)`).Scan(&ok); err != nil {
+		return err
+	}
+	if !ok {
+		return ErrLastAdmin
+	}
+	return nil
+}
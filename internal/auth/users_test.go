@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ZenithSolitude/Hopefully/internal/db"
+)
+
+func TestCheckManageUser(t *testing.T) {
+	setupDB(t)
+	if err := CreateRole("helpdesk", "", []string{"users.view", "users.manage"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateRole("security", "", []string{"roles.manage"}); err != nil {
+		t.Fatal(err)
+	}
+	admin := addUser(t, "root", AdminRole)
+	helpdesk := addUser(t, "helpdesk", "helpdesk")
+	security := addUser(t, "sec", "security")
+	plain := addUser(t, "bob", UserRole)
+	scoped := *admin
+	scoped.scopes = []string{"users.*"} // администратор с токеном только на users.*
+
+	tests := []struct {
+		name   string
+		actor  *User
+		target *User
+		err    error
+	}{
+		{"helpdesk → user", helpdesk, plain, nil},
+		{"helpdesk → admin", helpdesk, admin, ErrAdminTarget},
+		{"helpdesk → roles.manage holder", helpdesk, security, ErrAdminTarget},
+		{"admin → admin", admin, admin, nil},
+		{"roles.manage → admin", security, admin, nil},
+		{"admin via narrow token → admin", &scoped, admin, ErrAdminTarget},
+		{"admin via narrow token → user", &scoped, plain, nil},
+	}
+	for _, tt := range tests {
+		if err := CheckManageUser(tt.actor, tt.target.ID); !errors.Is(err, tt.err) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+// Пользователь только с users.manage получает 403 на сброс пароля
+// администратора — так же подключена проверка в обработчиках /users/<id>/….
+func TestManageAdminForbidden(t *testing.T) {
+	setupDB(t)
+	if err := CreateRole("helpdesk", "", []string{"users.view", "users.manage"}); err != nil {
+		t.Fatal(err)
+	}
+	admin := addUser(t, "root", AdminRole)
+	plain := addUser(t, "bob", UserRole)
+	helpdesk := addUser(t, "helpdesk", "helpdesk")
+	tok, err := NewToken(helpdesk.ID, login(t, helpdesk), lifetimes.Access)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reset := RequirePermission("users.manage")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.ParseInt(strings.Split(r.URL.Path, "/")[2], 10, 64)
+		if err := CheckManageUser(CtxGet(r), id); errors.Is(err, ErrAdminTarget) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		SetPassword(id, RandomPassword(), true)
+	}))
+	h := Middleware(reset)
+
+	for _, tt := range []struct {
+		target *User
+		code   int
+	}{{admin, http.StatusForbidden}, {plain, http.StatusOK}} {
+		req := httptest.NewRequest(http.MethodPost, "/users/"+strconv.FormatInt(tt.target.ID, 10)+"/password", nil)
+		req.AddCookie(&http.Cookie{Name: "tok", Value: tok})
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.code {
+			t.Errorf("reset %s: status %d, want %d", tt.target.Username, rec.Code, tt.code)
+		}
+	}
+	if u, _ := GetByID(admin.ID); u.MustChangePassword {
+		t.Fatal("admin password was reset")
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	setupDB(t)
+	admin := addUser(t, "root", AdminRole)
+	bob := addUser(t, "bob", UserRole)
+	ext := addUser(t, "alice", UserRole)
+	if _, err := db.DB.Exec(`UPDATE users SET auth_source = 'ldap' WHERE id = ?`, ext.ID); err != nil {
+		t.Fatal(err)
+	}
+	adminRole, _ := RoleID(AdminRole)
+	userRole, _ := RoleID(UserRole)
+
+	tests := []struct {
+		name     string
+		uid      int64
+		username string
+		roleIDs  []int64
+		err      error
+	}{
+		{"taken username with roles", bob.ID, "root", []int64{adminRole}, ErrUsernameTaken},
+		{"empty roles", bob.ID, "bob", []int64{}, ErrNoRoles},
+		{"demote last admin", admin.ID, "boss", []int64{userRole}, ErrLastAdmin},
+		{"rename external", ext.ID, "mallory", nil, ErrExternalLogin},
+		{"external keeps username", ext.ID, "alice", nil, nil},
+		{"rename local with roles", bob.ID, "robert", []int64{userRole}, nil},
+	}
+	for _, tt := range tests {
+		if err := UpdateUser(tt.uid, tt.username, "", "x@example.com", tt.roleIDs); !errors.Is(err, tt.err) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+
+	// Неудачные правки не оставили следов: ни ролей, ни нового логина.
+	for _, tt := range []struct {
+		uid      int64
+		username string
+		admin    bool
+	}{{admin.ID, "root", true}, {ext.ID, "alice", false}, {bob.ID, "robert", false}} {
+		u, err := GetByID(tt.uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Username != tt.username || u.IsAdmin != tt.admin {
+			t.Errorf("user %d: username %q admin %v, want %q %v", tt.uid, u.Username, u.IsAdmin, tt.username, tt.admin)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ── Backup and restore ────────────────────────────────────────────────────────
+
+// Копировать hopefully.db, пока сервер работает, нельзя: часть записей лежит
+// в -wal. Снимок делается через VACUUM INTO — согласованная копия без
+// остановки. Восстановление не трогает открытую базу: проверенная копия
+// кладётся рядом как restore.db и подменяет базу при следующем запуске.
+
+const (
+	FileName    = "hopefully.db"
+	RestoreFile = "restore.db"
+)
+
+// BackupInfo — что известно о копии после проверки.
+type BackupInfo struct {
+	Version int // версия схемы; 0 — копия сделана до нумерованных миграций
+	Users   int
+}
+
+// Backup записывает снимок открытой базы в dest. Файла dest быть не должно.
+func Backup(dest string) error { return vacuumInto(DB, dest) }
+
+// BackupFile — снимок базы из dataDir для командной строки: открывает её
+// отдельным соединением без миграций, сервер при этом может работать.
+func BackupFile(dataDir, dest string) error {
+	path := filepath.Join(dataDir, FileName)
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	d, err := sql.Open("sqlite3", path+"?_busy_timeout=5000")
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return vacuumInto(d, dest)
+}
+
+func vacuumInto(d *sql.DB, dest string) error {
+	if _, err := os.Stat(dest); err == nil {
+		return fmt.Errorf("%s already exists", dest)
+	}
+	if _, err := d.Exec(`VACUUM INTO ?`, dest); err != nil {
+		os.Remove(dest)
+		return fmt.Errorf("backup: %w", err)
+	}
+	// В копии хеши паролей и секреты 2FA
+	return os.Chmod(dest, 0600)
+}
+
+// StageRestore сохраняет копию из src как restore.db, если это целая база
+// Hopefully со схемой не новее этого бинарника. Подменит базу Init при
+// следующем запуске.
+func StageRestore(dataDir string, src io.Reader) (*BackupInfo, error) {
+	staged := filepath.Join(dataDir, RestoreFile)
+	tmp := staged + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(f, src)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	info, err := checkBackup(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	return info, os.Rename(tmp, staged)
+}
+
+// PendingRestore — подготовленная к восстановлению копия или nil.
+func PendingRestore(dataDir string) os.FileInfo {
+	st, err := os.Stat(filepath.Join(dataDir, RestoreFile))
+	if err != nil {
+		return nil
+	}
+	return st
+}
+
+// CancelRestore убирает подготовленную копию.
+func CancelRestore(dataDir string) error {
+	err := os.Remove(filepath.Join(dataDir, RestoreFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// checkBackup открывает копию и проверяет целостность, таблицу users и
+// версию схемы, затем переводит её из WAL в обычный журнал, чтобы копия
+// была одним файлом.
+func checkBackup(path string) (*BackupInfo, error) {
+	d, err := sql.Open("sqlite3", path+"?_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	d.SetMaxOpenConns(1)
+
+	var ok string
+	if err := d.QueryRow(`PRAGMA integrity_check`).Scan(&ok); err != nil {
+		return nil, fmt.Errorf("not a database: %w", err)
+	}
+	if ok != "ok" {
+		return nil, fmt.Errorf("integrity check failed: %s", ok)
+	}
+	info := &BackupInfo{}
+	if err := d.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&info.Users); err != nil {
+		return nil, fmt.Errorf("not a Hopefully database: %w", err)
+	}
+	ms, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(d)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkApplied(applied, ms); err != nil {
+		return nil, err
+	}
+	info.Version = maxKey(applied)
+	if _, err := d.Exec(`PRAGMA journal_mode=DELETE`); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// swapRestore подменяет базу подготовленной копией, если она есть. Прежняя
+// база остаётся рядом как hopefully.db.before-restore-<время>.
+func swapRestore(dataDir string) error {
+	staged := filepath.Join(dataDir, RestoreFile)
+	if _, err := os.Stat(staged); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	// Файл могли положить и вручную, мимо StageRestore
+	info, err := checkBackup(staged)
+	if err != nil {
+		return fmt.Errorf("%s: %w (remove it to start with the current database)", RestoreFile, err)
+	}
+	path := filepath.Join(dataDir, FileName)
+	prev := path + ".before-restore-" + time.Now().Format("20060102-150405")
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if err := os.Rename(path+suffix, prev+suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("restore: %w", err)
+		}
+	}
+	if err := os.Rename(staged, path); err != nil {
+		return fmt.Errorf("restore: %w", err)
+	}
+	log.Printf("db: restored from backup (schema version %d, %d users), previous database kept as %s",
+		info.Version, info.Users, filepath.Base(prev))
+	return nil
+}
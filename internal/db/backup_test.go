@@ -0,0 +1,105 @@
+package db
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// sqliteFile создаёт базу из stmts и возвращает её содержимое.
+func sqliteFile(t *testing.T, stmts ...string) []byte {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "x.db")
+	d, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range stmts {
+		if _, err := d.Exec(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.Close()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestStageRestoreRejects(t *testing.T) {
+	junk := make([]byte, 8192)
+	rand.Read(junk)
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"random bytes", junk, nil},
+		{"empty file", nil, nil},
+		{"not hopefully", sqliteFile(t, `CREATE TABLE notes (id INTEGER)`), nil},
+		{"schema too new", sqliteFile(t,
+			`CREATE TABLE users (id INTEGER)`,
+			`CREATE TABLE schema_migrations (version INTEGER PRIMARY KEY, name TEXT, checksum TEXT)`,
+			`INSERT INTO schema_migrations VALUES (99, 'future', 'x')`), ErrSchemaTooNew},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		_, err := StageRestore(dir, bytes.NewReader(tt.data))
+		if err == nil || (tt.err != nil && !errors.Is(err, tt.err)) {
+			t.Errorf("%s: err = %v", tt.name, err)
+		}
+		if left, _ := filepath.Glob(filepath.Join(dir, "*")); len(left) != 0 {
+			t.Errorf("%s: files left behind: %v", tt.name, left)
+		}
+	}
+}
+
+// Снимок рабочей базы принимается и при следующем Init подменяет её.
+func TestStageRestore(t *testing.T) {
+	dir := t.TempDir()
+	if err := Init(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DB.Exec(`INSERT INTO users (username, password) VALUES ('alice', '!')`); err != nil {
+		t.Fatal(err)
+	}
+	snap := filepath.Join(t.TempDir(), "backup.db")
+	if err := Backup(snap); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DB.Exec(`DELETE FROM users WHERE username = 'alice'`); err != nil {
+		t.Fatal(err)
+	}
+	DB.Close()
+
+	f, err := os.Open(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, err := StageRestore(dir, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != LatestSchema() || info.Users != 1 || PendingRestore(dir) == nil {
+		t.Fatalf("staged %+v", info)
+	}
+
+	if err := Init(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer DB.Close()
+	var n int
+	DB.QueryRow(`SELECT COUNT(*) FROM users WHERE username = 'alice'`).Scan(&n)
+	if n != 1 || PendingRestore(dir) != nil {
+		t.Fatalf("after restore: %d users named alice, pending %v", n, PendingRestore(dir))
+	}
+	if prev, _ := filepath.Glob(filepath.Join(dir, FileName+".before-restore-*")); len(prev) == 0 {
+		t.Fatal("previous database not kept")
+	}
+}
@@ -0,0 +1,234 @@
+package db
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ── Migrations ────────────────────────────────────────────────────────────────
+
+// Схема меняется только новыми файлами migrations/NNNN_name.sql: номера идут
+// подряд с 1, уже выпущенный файл не редактируется. Каждая миграция
+// выполняется в своей транзакции вместе с записью в schema_migrations;
+// контрольная сумма файла сверяется при каждом запуске.
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+type migration struct {
+	Version  int
+	Name     string
+	SQL      string
+	Checksum string
+}
+
+var ErrSchemaTooNew = errors.New("database schema is newer than this binary")
+
+func loadMigrations() ([]migration, error) {
+	files, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	var out []migration
+	for _, f := range files {
+		base := strings.TrimSuffix(path.Base(f), ".sql")
+		num, name, ok := strings.Cut(base, "_")
+		v, err := strconv.Atoi(num)
+		if !ok || err != nil || v <= 0 {
+			return nil, fmt.Errorf("%s: expected NNNN_name.sql", f)
+		}
+		b, err := migrationFiles.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(b)
+		out = append(out, migration{Version: v, Name: name, SQL: string(b), Checksum: hex.EncodeToString(sum[:])})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	for i, m := range out {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %04d_%s: versions must be consecutive from 1", m.Version, m.Name)
+		}
+	}
+	return out, nil
+}
+
+// SchemaVersion — последняя применённая к базе миграция (0 — ни одной).
+func SchemaVersion(d *sql.DB) (int, error) {
+	var v int
+	err := d.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&v)
+	if err != nil && strings.Contains(err.Error(), "no such table") {
+		return 0, nil
+	}
+	return v, err
+}
+
+// LatestSchema — версия схемы, которую знает этот бинарник.
+func LatestSchema() int {
+	ms, err := loadMigrations()
+	if err != nil {
+		return 0
+	}
+	return len(ms)
+}
+
+func migrate() error {
+	ms, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	if _, err := DB.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		name       TEXT    NOT NULL,
+		checksum   TEXT    NOT NULL,
+		applied_at TEXT    NOT NULL DEFAULT (datetime('now'))
+	)`); err != nil {
+		return err
+	}
+
+	applied, err := appliedMigrations(DB)
+	if err != nil {
+		return err
+	}
+	if err := checkApplied(applied, ms); err != nil {
+		return err
+	}
+
+	if len(applied) == 0 {
+		if err := upgradeLegacy(); err != nil {
+			return err
+		}
+	}
+	for _, m := range ms {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		if err := apply(m); err != nil {
+			return fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		log.Printf("db: applied migration %04d_%s", m.Version, m.Name)
+	}
+	return nil
+}
+
+// appliedMigrations — версии и контрольные суммы применённых к базе миграций.
+// База без schema_migrations (созданная до миграций) — пустой список.
+func appliedMigrations(d *sql.DB) (map[int]string, error) {
+	applied := map[int]string{}
+	rows, err := d.Query(`SELECT version, checksum FROM schema_migrations`)
+	if err != nil {
+		if strings.Contains(err.Error(), "no such table") {
+			return applied, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v int
+		var sum string
+		if err := rows.Scan(&v, &sum); err != nil {
+			return nil, err
+		}
+		applied[v] = sum
+	}
+	return applied, rows.Err()
+}
+
+// checkApplied отказывает, если база новее бинарника или применённая
+// миграция с тех пор изменилась.
+func checkApplied(applied map[int]string, ms []migration) error {
+	if v := maxKey(applied); v > len(ms) {
+		return fmt.Errorf("%w: database is at version %d, this binary knows up to %d — upgrade Hopefully or restore a backup",
+			ErrSchemaTooNew, v, len(ms))
+	}
+	for _, m := range ms {
+		if sum, ok := applied[m.Version]; ok && sum != m.Checksum {
+			return fmt.Errorf("migration %04d_%s was changed after it had been applied (checksum mismatch)", m.Version, m.Name)
+		}
+	}
+	return nil
+}
+
+func apply(m migration) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(m.SQL); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_migrations (version, name, checksum) VALUES (?, ?, ?)`,
+		m.Version, m.Name, m.Checksum); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func maxKey(m map[int]string) int {
+	n := 0
+	for k := range m {
+		n = max(n, k)
+	}
+	return n
+}
+
+// upgradeLegacy доводит базу, созданную до нумерованных миграций, до схемы
+// 0001_initial: колонки, добавленные после первого релиза, CREATE TABLE IF
+// NOT EXISTS в старой базе не добавит. На новой базе ничего не делает.
+func upgradeLegacy() error {
+	columns := []struct{ table, name, def string }{
+		{"modules", "restart_count", "INTEGER NOT NULL DEFAULT 0"},
+		{"modules", "last_exit_code", "INTEGER"},
+		{"modules", "port", "INTEGER NOT NULL DEFAULT 0"},
+		{"modules", "assertion_key", "TEXT NOT NULL DEFAULT ''"},
+		{"sessions", "remember", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "totp_secret", "TEXT NOT NULL DEFAULT ''"},
+		{"users", "totp_enabled", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "totp_last_step", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "must_change_password", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "auth_source", "TEXT NOT NULL DEFAULT 'local'"},
+	}
+	for _, c := range columns {
+		if err := addColumn(c.table, c.name, c.def); err != nil {
+			return fmt.Errorf("%s.%s: %w", c.table, c.name, err)
+		}
+	}
+	return nil
+}
+
+// addColumn добавляет колонку, если таблица есть, а колонки в ней нет.
+func addColumn(table, name, def string) error {
+	rows, err := DB.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	found := false
+	for rows.Next() {
+		var col string
+		if err := rows.Scan(&col); err != nil {
+			return err
+		}
+		if col == name {
+			return nil
+		}
+		found = true
+	}
+	rows.Close()
+	if !found {
+		return nil // таблицы нет — её создаст миграция
+	}
+	_, err = DB.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, name, def))
+	return err
+}
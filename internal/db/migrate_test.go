@@ -0,0 +1,54 @@
+package db
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckApplied(t *testing.T) {
+	ms := []migration{
+		{Version: 1, Name: "initial", Checksum: "aaa"},
+		{Version: 2, Name: "next", Checksum: "bbb"},
+	}
+	tests := []struct {
+		name    string
+		applied map[int]string
+		ok      bool
+		err     error
+	}{
+		{"fresh database", map[int]string{}, true, nil},
+		{"partially applied", map[int]string{1: "aaa"}, true, nil},
+		{"up to date", map[int]string{1: "aaa", 2: "bbb"}, true, nil},
+		{"too new", map[int]string{1: "aaa", 2: "bbb", 3: "ccc"}, false, ErrSchemaTooNew},
+		{"checksum changed", map[int]string{1: "aaa", 2: "changed"}, false, nil},
+	}
+	for _, tt := range tests {
+		err := checkApplied(tt.applied, ms)
+		if (err == nil) != tt.ok || (tt.err != nil && !errors.Is(err, tt.err)) {
+			t.Errorf("%s: err = %v", tt.name, err)
+		}
+	}
+}
+
+// Встроенные миграции идут подряд, и свежая база получает их все.
+func TestMigrate(t *testing.T) {
+	ms, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) == 0 || LatestSchema() != len(ms) {
+		t.Fatalf("%d migrations, latest %d", len(ms), LatestSchema())
+	}
+	dir := t.TempDir()
+	if err := Init(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer DB.Close()
+	if v, err := SchemaVersion(DB); err != nil || v != len(ms) {
+		t.Fatalf("schema version %d, %v", v, err)
+	}
+	// Повторный запуск ничего не применяет и не ругается на контрольные суммы
+	if err := migrate(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,127 @@
+-- Схема на момент перехода на нумерованные миграции. Базы, созданные раньше,
+-- перед этой миграцией доводятся до неё в upgradeLegacy (см. migrate.go).
+
+CREATE TABLE IF NOT EXISTS users (
+	id                   INTEGER PRIMARY KEY AUTOINCREMENT,
+	username             TEXT    UNIQUE NOT NULL,
+	password             TEXT    NOT NULL,
+	full_name            TEXT    NOT NULL DEFAULT '',
+	email                TEXT    NOT NULL DEFAULT '',
+	is_admin             INTEGER NOT NULL DEFAULT 0,
+	is_active            INTEGER NOT NULL DEFAULT 1,
+	created_at           TEXT    NOT NULL DEFAULT (datetime('now')),
+	last_login           TEXT,
+	totp_secret          TEXT    NOT NULL DEFAULT '',
+	totp_enabled         INTEGER NOT NULL DEFAULT 0,
+	totp_last_step       INTEGER NOT NULL DEFAULT 0,
+	must_change_password INTEGER NOT NULL DEFAULT 0,
+	auth_source          TEXT    NOT NULL DEFAULT 'local'
+);
+
+CREATE TABLE IF NOT EXISTS roles (
+	id          INTEGER PRIMARY KEY AUTOINCREMENT,
+	name        TEXT    UNIQUE NOT NULL,
+	description TEXT    NOT NULL DEFAULT '',
+	permissions TEXT    NOT NULL DEFAULT '[]',
+	is_system   INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS user_roles (
+	user_id INTEGER NOT NULL REFERENCES users(id)  ON DELETE CASCADE,
+	role_id INTEGER NOT NULL REFERENCES roles(id)  ON DELETE CASCADE,
+	PRIMARY KEY (user_id, role_id)
+);
+
+CREATE TABLE IF NOT EXISTS modules (
+	id             INTEGER PRIMARY KEY AUTOINCREMENT,
+	name           TEXT    UNIQUE NOT NULL,
+	version        TEXT    NOT NULL DEFAULT '0.0.0',
+	description    TEXT    NOT NULL DEFAULT '',
+	author         TEXT    NOT NULL DEFAULT '',
+	status         TEXT    NOT NULL DEFAULT 'inactive',
+	source_type    TEXT    NOT NULL DEFAULT '',
+	source_url     TEXT    NOT NULL DEFAULT '',
+	manifest       TEXT    NOT NULL DEFAULT '{}',
+	error_log      TEXT    NOT NULL DEFAULT '',
+	installed_at   TEXT    NOT NULL DEFAULT (datetime('now')),
+	restart_count  INTEGER NOT NULL DEFAULT 0,
+	last_exit_code INTEGER,
+	port           INTEGER NOT NULL DEFAULT 0,
+	assertion_key  TEXT    NOT NULL DEFAULT ''
+);
+
+-- Личные API-токены: хранится только SHA-256, scopes — JSON-массив прав
+CREATE TABLE IF NOT EXISTS api_tokens (
+	id           INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id      INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	name         TEXT    NOT NULL,
+	token_hash   TEXT    UNIQUE NOT NULL,
+	prefix       TEXT    NOT NULL,
+	scopes       TEXT    NOT NULL DEFAULT '[]',
+	created_at   TEXT    NOT NULL DEFAULT (datetime('now')),
+	expires_at   TEXT,
+	last_used_at TEXT
+);
+
+-- Сессии входа: id совпадает с jti JWT в cookie; удалённая строка — отозванная сессия
+CREATE TABLE IF NOT EXISTS sessions (
+	id           TEXT    PRIMARY KEY,
+	user_id      INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	ip           TEXT    NOT NULL DEFAULT '',
+	user_agent   TEXT    NOT NULL DEFAULT '',
+	created_at   TEXT    NOT NULL DEFAULT (datetime('now')),
+	last_seen_at TEXT    NOT NULL DEFAULT (datetime('now')),
+	expires_at   TEXT    NOT NULL,
+	remember     INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS sessions_user ON sessions(user_id);
+
+-- Коды восстановления 2FA: одноразовые, хранится SHA-256
+CREATE TABLE IF NOT EXISTS recovery_codes (
+	id        INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id   INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	code_hash TEXT    NOT NULL
+);
+
+-- Неудачные входы по IP и по логину (scope = 'ip' | 'user') и блокировки
+CREATE TABLE IF NOT EXISTS login_failures (
+	scope        TEXT    NOT NULL,
+	key          TEXT    NOT NULL,
+	failures     INTEGER NOT NULL DEFAULT 0,
+	last_failure TEXT    NOT NULL,
+	locked_until TEXT,
+	PRIMARY KEY (scope, key)
+);
+
+-- Настройки портала, меняемые из интерфейса
+CREATE TABLE IF NOT EXISTS settings (
+	key   TEXT PRIMARY KEY,
+	value TEXT NOT NULL DEFAULT ''
+);
+
+-- Журнал действий; user_id без внешнего ключа — записи переживают удаление пользователя
+CREATE TABLE IF NOT EXISTS audit_events (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	created_at TEXT    NOT NULL DEFAULT (datetime('now')),
+	user_id    INTEGER,
+	actor      TEXT    NOT NULL DEFAULT '',
+	action     TEXT    NOT NULL,
+	target     TEXT    NOT NULL DEFAULT '',
+	ip         TEXT    NOT NULL DEFAULT '',
+	details    TEXT    NOT NULL DEFAULT '{}'
+);
+CREATE INDEX IF NOT EXISTS audit_events_created ON audit_events(created_at);
+CREATE INDEX IF NOT EXISTS audit_events_actor ON audit_events(actor);
+
+-- Начальные роли
+INSERT OR IGNORE INTO roles (name, description, permissions, is_system)
+VALUES ('admin', 'Администратор', '["*"]', 1);
+INSERT OR IGNORE INTO roles (name, description, permissions, is_system)
+VALUES ('user',  'Пользователь',  '["dashboard.view","modules.view"]', 1);
+
+-- Пользователи без ролей (созданные до того, как роли начали проверяться):
+-- администраторам — admin, остальным — user.
+INSERT OR IGNORE INTO user_roles (user_id, role_id)
+SELECT u.id, r.id FROM users u JOIN roles r
+  ON r.name = CASE WHEN u.is_admin THEN 'admin' ELSE 'user' END
+WHERE NOT EXISTS (SELECT 1 FROM user_roles ur WHERE ur.user_id = u.id);
@@ -0,0 +1,7 @@
+-- Неизменный идентификатор пользователя во внешнем источнике (для OIDC —
+-- issuer и sub). Учётная запись привязывается к нему, а не к логину,
+-- который провайдер может отдать другому человеку.
+
+ALTER TABLE users ADD COLUMN external_id TEXT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_external_id ON users (auth_source, external_id) WHERE external_id IS NOT NULL;
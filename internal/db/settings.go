@@ -0,0 +1,15 @@
+package db
+
+// Setting возвращает значение настройки портала ("" — не задана).
+func Setting(key string) string {
+	var v string
+	DB.QueryRow(`SELECT value FROM settings WHERE key = ?`, key).Scan(&v)
+	return v
+}
+
+func SetSetting(key, value string) error {
+	_, err := DB.Exec(
+		`INSERT INTO settings (key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value = excluded.value`,
+		key, value)
+	return err
+}
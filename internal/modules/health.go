@@ -0,0 +1,164 @@
+package modules
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os/exec"
+	"time"
+)
+
+// Healthcheck — блок "healthcheck" в manifest.json. Задаётся ровно один
+// из способов проверки: http, tcp или exec.
+type Healthcheck struct {
+	HTTP        string   `json:"http"`         // путь, например "/health"; 2xx/3xx — здоров
+	TCP         bool     `json:"tcp"`          // достаточно принять соединение на порту
+	Exec        []string `json:"exec"`         // команда в каталоге модуля; код 0 — здоров
+	Interval    int      `json:"interval"`     // секунды между проверками, по умолчанию 10
+	Timeout     int      `json:"timeout"`      // секунды на одну проверку, по умолчанию 3
+	Retries     int      `json:"retries"`      // неудач подряд до unhealthy, по умолчанию 3
+	StartPeriod int      `json:"start_period"` // секунды после старта, когда неудачи не считаются
+}
+
+func (hc *Healthcheck) validate(mf *Manifest) error {
+	n := 0
+	if hc.HTTP != "" {
+		n++
+	}
+	if hc.TCP {
+		n++
+	}
+	if len(hc.Exec) > 0 {
+		n++
+	}
+	if n != 1 {
+		return fmt.Errorf("healthcheck: exactly one of http, tcp, exec is required")
+	}
+	if mf.Entrypoint == "" {
+		return fmt.Errorf("healthcheck: requires entrypoint")
+	}
+	return nil
+}
+
+func (hc *Healthcheck) interval() time.Duration { return secondsOr(hc.Interval, 10*time.Second) }
+func (hc *Healthcheck) timeout() time.Duration  { return secondsOr(hc.Timeout, 3*time.Second) }
+func (hc *Healthcheck) startPeriod() time.Duration {
+	return secondsOr(hc.StartPeriod, 0)
+}
+func (hc *Healthcheck) retries() int {
+	if hc.Retries <= 0 {
+		return 3
+	}
+	return hc.Retries
+}
+
+func secondsOr(n int, def time.Duration) time.Duration {
+	if n <= 0 {
+		return def
+	}
+	return time.Duration(n) * time.Second
+}
+
+// IsServing — модуль принимает запросы: его можно проксировать и показывать в меню.
+// unhealthy сюда входит: модуль может отвечать частично, в меню он помечается.
+func IsServing(status string) bool {
+	return status == "active" || status == "healthy" || status == "unhealthy"
+}
+
+// initialStatus — статус сразу после запуска процесса.
+func (mf *Manifest) initialStatus() string {
+	if mf != nil && mf.Healthcheck != nil {
+		return "starting"
+	}
+	return "active"
+}
+
+// watchHealth периодически проверяет модуль, пока жив процесс cmd.
+// Переводит его между starting / healthy / unhealthy.
+func (r *Registry) watchHealth(m *Module, cmd *exec.Cmd, done, quit chan struct{}) {
+	hc := m.Manifest.Healthcheck
+	started := time.Now()
+	failures := 0
+	// Первая проверка — вскоре после старта, чтобы не держать модуль в starting весь interval.
+	wait := time.Second
+	for {
+		select {
+		case <-done:
+			return
+		case <-quit:
+			return
+		case <-time.After(wait):
+		}
+		wait = hc.interval()
+
+		err := r.probe(m, hc)
+		r.mu.Lock()
+		if m.proc != cmd {
+			r.mu.Unlock()
+			return
+		}
+		prev := m.Status
+		switch {
+		case err == nil:
+			failures = 0
+			m.Status = "healthy"
+			m.ErrorLog = ""
+		case prev == "starting" && time.Since(started) < hc.startPeriod():
+			// ещё прогревается
+		default:
+			failures++
+			if failures >= hc.retries() {
+				m.Status = "unhealthy"
+				m.ErrorLog = "healthcheck: " + err.Error()
+			}
+		}
+		if m.Status != prev {
+			log.Printf("modules: %s %s → %s", m.Name, prev, m.Status)
+			r.saveState(m)
+		}
+		r.mu.Unlock()
+	}
+}
+
+// probe выполняет одну проверку здоровья модуля.
+func (r *Registry) probe(m *Module, hc *Healthcheck) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hc.timeout())
+	defer cancel()
+	network, addr := m.upstream()
+	switch {
+	case hc.HTTP != "":
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+m.Name+hc.HTTP, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := m.Transport().RoundTrip(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("GET %s: %s", hc.HTTP, resp.Status)
+		}
+		return nil
+	case hc.TCP:
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	default:
+		cmd := exec.CommandContext(ctx, hc.Exec[0], hc.Exec[1:]...)
+		cmd.Dir = r.moduleDir(m.Name)
+		cmd.Env = m.env
+		if out, err := cmd.CombinedOutput(); err != nil {
+			if len(out) > 200 {
+				out = out[:200]
+			}
+			return fmt.Errorf("%v: %s", err, out)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,99 @@
+package modules
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProbe(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+		case "/moved":
+			http.Redirect(w, r, "/health", http.StatusFound)
+		default:
+			http.Error(w, "down", http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().String()
+	l.Close()
+
+	r := &Registry{dataDir: t.TempDir()}
+	os.MkdirAll(r.moduleDir("demo"), 0755)
+	tests := []struct {
+		name string
+		addr string
+		hc   Healthcheck
+		ok   bool
+	}{
+		{"http 200", srv.Listener.Addr().String(), Healthcheck{HTTP: "/health"}, true},
+		{"http 302", srv.Listener.Addr().String(), Healthcheck{HTTP: "/moved"}, true},
+		{"http 503", srv.Listener.Addr().String(), Healthcheck{HTTP: "/fail"}, false},
+		{"http refused", closed, Healthcheck{HTTP: "/health"}, false},
+		{"tcp open", srv.Listener.Addr().String(), Healthcheck{TCP: true}, true},
+		{"tcp refused", closed, Healthcheck{TCP: true}, false},
+		{"exec ok", "", Healthcheck{Exec: []string{"true"}}, true},
+		{"exec fails", "", Healthcheck{Exec: []string{"false"}}, false},
+		{"exec timeout", "", Healthcheck{Exec: []string{"sleep", "5"}, Timeout: 1}, false},
+	}
+	for _, tt := range tests {
+		m := &Module{Name: "demo"}
+		if tt.addr != "" {
+			m.setUpstream("tcp", tt.addr)
+		}
+		if err := r.probe(m, &tt.hc); (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v", tt.name, err)
+		}
+	}
+}
+
+func TestHealthcheckValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		mf   Manifest
+		ok   bool
+	}{
+		{"http", Manifest{Entrypoint: "run.sh", Healthcheck: &Healthcheck{HTTP: "/health"}}, true},
+		{"none", Manifest{Entrypoint: "run.sh", Healthcheck: &Healthcheck{}}, false},
+		{"two methods", Manifest{Entrypoint: "run.sh", Healthcheck: &Healthcheck{HTTP: "/h", TCP: true}}, false},
+		{"no entrypoint", Manifest{Healthcheck: &Healthcheck{TCP: true}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.mf.Healthcheck.validate(&tt.mf); (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v", tt.name, err)
+		}
+	}
+}
+
+// Модуль с проверкой стартует в starting, становится healthy, а после
+// retries неудач подряд — unhealthy, и возвращается, когда проверка проходит.
+func TestWatchHealth(t *testing.T) {
+	r := newTestRegistry(t)
+	m := addModule(t, r, "probed", Manifest{Healthcheck: &Healthcheck{
+		Exec: []string{"test", "-f", "ok"}, Interval: 1, Retries: 2,
+	}}, "exec sleep 60")
+	ok := filepath.Join(r.moduleDir(m.Name), "ok")
+	if err := r.Activate(m.Name); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, r, m, "starting", time.Second)
+	os.WriteFile(ok, nil, 0644)
+	waitStatus(t, r, m, "healthy", 5*time.Second)
+	os.Remove(ok)
+	st := waitStatus(t, r, m, "unhealthy", 5*time.Second)
+	if st.ErrorLog == "" {
+		t.Error("unhealthy without a reason")
+	}
+	os.WriteFile(ok, nil, 0644)
+	waitStatus(t, r, m, "healthy", 5*time.Second)
+}
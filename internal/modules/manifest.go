@@ -6,9 +6,13 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
 )
 
-var nameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{1,63}$`)
+var (
+	nameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{1,63}$`)
+	permRe = regexp.MustCompile(`^[a-z0-9_-]+(\.[a-z0-9_-]+)+$`)
+)
 
 type Manifest struct {
 	Name        string            `json:"name"`
@@ -20,9 +24,37 @@ type Manifest struct {
 	Entrypoint  string            `json:"entrypoint"`
 	Args        []string          `json:"args"`
 	Env         map[string]string `json:"env"`
-	Port        int               `json:"port"`
+	Port        PortSpec          `json:"port"`
+	Listen      string            `json:"listen"` // tcp (по умолчанию) | unix
 	Requires    []string          `json:"requires"`
 	Menu        MenuItem          `json:"menu"`
+	Restart     string            `json:"restart"`      // always | on-failure | never
+	MaxRetries  int               `json:"max_retries"`  // падений в окне до crashloop
+	RetryWindow int               `json:"retry_window"` // окно, секунды
+	StopTimeout int               `json:"stop_timeout"` // ожидание после SIGTERM, секунды
+	Healthcheck *Healthcheck      `json:"healthcheck"`
+	Permissions []string          `json:"permissions"` // нужны пользователю, чтобы открыть модуль
+}
+
+// PortSpec — значение "port": номер порта либо "auto". 0 (в т.ч. отсутствие
+// поля) означает, что порт выделит реестр из диапазона.
+type PortSpec int
+
+func (p *PortSpec) UnmarshalJSON(b []byte) error {
+	var s string
+	if json.Unmarshal(b, &s) == nil {
+		if s != "auto" {
+			return fmt.Errorf(`port must be a number or "auto", got %q`, s)
+		}
+		*p = 0
+		return nil
+	}
+	var n int
+	if err := json.Unmarshal(b, &n); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf(`port must be a number or "auto", got %s`, b)
+	}
+	*p = PortSpec(n)
+	return nil
 }
 
 type MenuItem struct {
@@ -47,6 +79,37 @@ func loadManifest(dir string) (*Manifest, error) {
 	if m.Version == "" {
 		return nil, fmt.Errorf("version is required")
 	}
+	switch m.Restart {
+	case "", RestartAlways, RestartOnFailure, RestartNever:
+	default:
+		return nil, fmt.Errorf("restart must be %q, %q or %q, got %q", RestartAlways, RestartOnFailure, RestartNever, m.Restart)
+	}
+	switch m.Listen {
+	case "", ListenTCP:
+	case ListenUnix:
+		if m.Port != 0 {
+			return nil, fmt.Errorf("port is not used with listen %q", ListenUnix)
+		}
+	default:
+		return nil, fmt.Errorf("listen must be %q or %q, got %q", ListenTCP, ListenUnix, m.Listen)
+	}
+	// Права модуля живут в его пространстве имён: иначе модуль мог бы
+	// объявить права портала (users.manage и т. п.), и кнопка «Доступ»
+	// выдавала бы их ролям.
+	prefix := "module." + m.Name + "."
+	for _, p := range m.Permissions {
+		if !permRe.MatchString(p) {
+			return nil, fmt.Errorf("permission must match %s, got %q", permRe, p)
+		}
+		if !strings.HasPrefix(p, prefix) {
+			return nil, fmt.Errorf("permission must start with %q, got %q", prefix, p)
+		}
+	}
+	if m.Healthcheck != nil {
+		if err := m.Healthcheck.validate(&m); err != nil {
+			return nil, err
+		}
+	}
 	return &m, nil
 }
 
@@ -0,0 +1,36 @@
+package modules
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadManifestPermissions(t *testing.T) {
+	tests := []struct {
+		perms string
+		err   string
+	}{
+		{`[]`, ""},
+		{`["module.backup.view", "module.backup.restore"]`, ""},
+		{`["users.manage"]`, `must start with "module.backup."`},
+		{`["module.other.view"]`, `must start with "module.backup."`},
+		{`["module.backup"]`, `must start with "module.backup."`},
+		{`["module.backup.View"]`, "must match"},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		manifest := `{"name": "backup", "version": "1.0", "permissions": ` + tt.perms + `}`
+		if err := os.WriteFile(filepath.Join(dir, "manifest.json"), []byte(manifest), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := loadManifest(dir)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.perms, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: err = %v, want %q", tt.perms, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package modules
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/ZenithSolitude/Hopefully/internal/db"
+)
+
+// Диапазон loopback-портов для модулей без фиксированного "port".
+const (
+	defaultPortMin = 9200
+	defaultPortMax = 9999
+)
+
+// ParsePortRange разбирает диапазон вида "9200-9999".
+func ParsePortRange(s string) (lo, hi int, err error) {
+	a, b, ok := strings.Cut(s, "-")
+	if ok {
+		lo, err = strconv.Atoi(strings.TrimSpace(a))
+		if err == nil {
+			hi, err = strconv.Atoi(strings.TrimSpace(b))
+		}
+	}
+	if !ok || err != nil || lo < 1 || hi > 65535 || lo > hi {
+		return 0, 0, fmt.Errorf("invalid port range %q, want e.g. 9200-9999", s)
+	}
+	return lo, hi, nil
+}
+
+// SetPortRange задаёт диапазон автоматически выделяемых портов.
+func (r *Registry) SetPortRange(lo, hi int) {
+	r.mu.Lock()
+	r.portMin, r.portMax = lo, hi
+	r.mu.Unlock()
+}
+
+// assignPort выбирает порт перед каждым запуском модуля, в том числе
+// перезапуском после падения, и сохраняет его в БД.
+// Фиксированный порт проверяется на занятость другими модулями и процессами,
+// автоматический — переиспользуется, если ещё свободен. Вызывается под r.mu.
+func (r *Registry) assignPort(m *Module) error {
+	if m.Manifest == nil || m.Manifest.Entrypoint == "" || m.Manifest.listen() == ListenUnix {
+		if m.Port != 0 {
+			m.Port = 0
+			db.DB.Exec(`UPDATE modules SET port=0 WHERE name=?`, m.Name)
+		}
+		return nil
+	}
+	if fixed := int(m.Manifest.Port); fixed != 0 {
+		if other := r.portOwner(fixed, m, false); other != "" {
+			return fmt.Errorf("port %d is already used by module %q", fixed, other)
+		}
+		if !portFree(fixed) {
+			return fmt.Errorf("port %d is already in use by another process", fixed)
+		}
+		m.Port = fixed
+	} else if m.Port == 0 || !r.inRange(m.Port) || r.portOwner(m.Port, m, true) != "" || !portFree(m.Port) {
+		port, err := r.freePort(m)
+		if err != nil {
+			return err
+		}
+		m.Port = port
+	}
+	db.DB.Exec(`UPDATE modules SET port=? WHERE name=?`, m.Port, m.Name)
+	return nil
+}
+
+func (r *Registry) freePort(m *Module) (int, error) {
+	lo, hi := r.portMin, r.portMax
+	if lo == 0 {
+		lo, hi = defaultPortMin, defaultPortMax
+	}
+	for p := lo; p <= hi; p++ {
+		if r.portOwner(p, m, true) == "" && portFree(p) {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("no free port in range %d-%d", lo, hi)
+}
+
+func (r *Registry) inRange(p int) bool {
+	if r.portMin == 0 {
+		return p >= defaultPortMin && p <= defaultPortMax
+	}
+	return p >= r.portMin && p <= r.portMax
+}
+
+// portOwner — имя другого запущенного модуля, который держит порт p.
+// С declared учитываются и фиксированные порты из манифестов остановленных
+// модулей — чтобы автоматическое выделение их не заняло.
+func (r *Registry) portOwner(p int, self *Module, declared bool) string {
+	for _, o := range r.byName {
+		if o == self || o.Manifest == nil {
+			continue
+		}
+		if (o.Port == p && IsRunning(o.Status)) || (declared && int(o.Manifest.Port) == p) {
+			return o.Name
+		}
+	}
+	return ""
+}
+
+func portFree(p int) bool {
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", p))
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
@@ -0,0 +1,111 @@
+package modules
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		in     string
+		lo, hi int
+		ok     bool
+	}{
+		{"9200-9999", 9200, 9999, true},
+		{" 8000 - 8000 ", 8000, 8000, true},
+		{"9999-9200", 0, 0, false},
+		{"0-100", 0, 0, false},
+		{"9000-70000", 0, 0, false},
+		{"9200", 0, 0, false},
+		{"a-b", 0, 0, false},
+	}
+	for _, tt := range tests {
+		lo, hi, err := ParsePortRange(tt.in)
+		if (err == nil) != tt.ok || lo != tt.lo || hi != tt.hi {
+			t.Errorf("ParsePortRange(%q) = %d, %d, %v", tt.in, lo, hi, err)
+		}
+	}
+}
+
+// freeRange ищет n подряд свободных портов и возвращает первый.
+func freeRange(t *testing.T, n int) int {
+	t.Helper()
+	for base := 39200; base < 40000; base += n {
+		ok := true
+		for p := base; p < base+n && ok; p++ {
+			ok = portFree(p)
+		}
+		if ok {
+			return base
+		}
+	}
+	t.Skip("no free port range")
+	return 0
+}
+
+func listen(t *testing.T, port int) {
+	t.Helper()
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+}
+
+func TestAssignPort(t *testing.T) {
+	r := newTestRegistry(t)
+	base := freeRange(t, 4)
+	r.SetPortRange(base, base+3)
+	l, err := net.Listen("tcp", "127.0.0.1:0") // занят чужим процессом
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	busy := l.Addr().(*net.TCPAddr).Port
+
+	running := addModule(t, r, "running", Manifest{Port: PortSpec(base + 3)}, "exit 0")
+	running.Port, running.Status = base+3, "active"
+	stopped := addModule(t, r, "stopped", Manifest{Port: PortSpec(base)}, "exit 0")
+	stopped.Status = "inactive"
+
+	tests := []struct {
+		name    string
+		mf      Manifest
+		prev    int // порт с прошлого запуска
+		want    int // 0 — ожидается ошибка
+		errPart string
+	}{
+		{"auto skips declared and running", Manifest{Entrypoint: "run.sh"}, 0, base + 1, ""},
+		{"auto keeps previous", Manifest{Entrypoint: "run.sh"}, base + 2, base + 2, ""},
+		{"auto moves off a taken port", Manifest{Entrypoint: "run.sh"}, base + 3, base + 1, ""},
+		{"auto moves into the range", Manifest{Entrypoint: "run.sh"}, busy, base + 1, ""},
+		{"fixed free", Manifest{Entrypoint: "run.sh", Port: PortSpec(base + 2)}, 0, base + 2, ""},
+		{"fixed of a running module", Manifest{Entrypoint: "run.sh", Port: PortSpec(base + 3)}, 0, 0, `module "running"`},
+		{"fixed held by a process", Manifest{Entrypoint: "run.sh", Port: PortSpec(busy)}, 0, 0, "another process"},
+		{"unix socket", Manifest{Entrypoint: "run.sh", Listen: ListenUnix}, base + 2, 0, ""},
+		{"no entrypoint", Manifest{}, base + 2, 0, ""},
+	}
+	for _, tt := range tests {
+		m := &Module{Name: "subject", Manifest: &tt.mf, Port: tt.prev}
+		err := r.assignPort(m)
+		switch {
+		case tt.errPart != "":
+			if err == nil || !strings.Contains(err.Error(), tt.errPart) {
+				t.Errorf("%s: err = %v, want %q", tt.name, err, tt.errPart)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case m.Port != tt.want:
+			t.Errorf("%s: port %d, want %d", tt.name, m.Port, tt.want)
+		}
+	}
+
+	// Диапазон исчерпан
+	listen(t, base+1)
+	listen(t, base+2)
+	if err := r.assignPort(&Module{Name: "subject", Manifest: &Manifest{Entrypoint: "run.sh"}}); err == nil {
+		t.Error("expected an error when the range is exhausted")
+	}
+}
@@ -0,0 +1,153 @@
+package modules
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ZenithSolitude/Hopefully/internal/db"
+	"github.com/ZenithSolitude/Hopefully/pkg/moduleauth"
+)
+
+// ProxyPrefix — под этим путём портал отдаёт HTTP модулей: /module-proxy/<name>/...
+const ProxyPrefix = "/module-proxy/"
+
+// assertionTTL — срок жизни X-Hopefully-Assertion: утверждение выпускается
+// на каждый запрос, долго жить ему незачем.
+const assertionTTL = time.Minute
+
+// Identity — пользователь портала, от имени которого идёт запрос в модуль.
+type Identity struct {
+	UserID   int64
+	Username string
+	Roles    []string
+	ClientIP string // адрес клиента с учётом доверенных прокси; пусто — адрес соединения
+}
+
+// ServeProxy проксирует запрос в модуль: WebSocket/Upgrade, потоковые ответы
+// (SSE) без буферизации, X-Forwarded-* и переписывание Location под префикс.
+// Модуль получает identity в заголовках X-Hopefully-*; учётные данные портала
+// вызывающий должен убрать из r сам.
+func (m *Module) ServeProxy(w http.ResponseWriter, r *http.Request, id Identity) {
+	if r.Header.Get("Upgrade") != "" {
+		// Сервер ставит дедлайны чтения на соединение; после Hijack они
+		// остались бы и оборвали WebSocket через ReadTimeout.
+		rc := http.NewResponseController(w)
+		rc.SetReadDeadline(time.Time{})
+		rc.SetWriteDeadline(time.Time{})
+	}
+	m.reverseProxy(id).ServeHTTP(w, r)
+}
+
+func (m *Module) reverseProxy(id Identity) *httputil.ReverseProxy {
+	prefix := ProxyPrefix + m.Name
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			out := pr.Out.URL
+			out.Scheme = "http"
+			out.Host = m.Name // хост не важен: транспорт модуля сам выбирает порт или сокет
+			out.Path = strings.TrimPrefix(pr.In.URL.Path, prefix)
+			out.RawPath = strings.TrimPrefix(pr.In.URL.RawPath, prefix)
+			if out.Path == "" {
+				out.Path, out.RawPath = "/", ""
+			}
+			pr.SetXForwarded()
+			if id.ClientIP != "" {
+				// SetXForwarded берёт адрес соединения — за прокси это сам прокси.
+				pr.Out.Header.Set("X-Forwarded-For", id.ClientIP)
+			}
+			pr.Out.Header.Set("X-Forwarded-Prefix", prefix)
+			m.setIdentity(pr.Out.Header, id)
+		},
+		Transport:     m.Transport(),
+		FlushInterval: -1,
+		ModifyResponse: func(resp *http.Response) error {
+			if loc := resp.Header.Get("Location"); loc != "" {
+				resp.Header.Set("Location", rewriteLocation(loc, prefix, resp.Request))
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("modules: proxy %s: %v", m.Name, err)
+			http.Error(w, "module unreachable", http.StatusBadGateway)
+		},
+	}
+}
+
+// setIdentity заменяет присланные браузером X-Hopefully-* заголовками портала.
+func (m *Module) setIdentity(h http.Header, id Identity) {
+	h.Del(moduleauth.HeaderUser)
+	h.Del(moduleauth.HeaderRoles)
+	h.Del(moduleauth.HeaderAssertion)
+	if id.Username == "" {
+		return
+	}
+	h.Set(moduleauth.HeaderUser, id.Username)
+	h.Set(moduleauth.HeaderRoles, strings.Join(id.Roles, ","))
+	if len(m.assertionKey) == 0 {
+		return
+	}
+	now := time.Now()
+	tok, err := moduleauth.Sign(moduleauth.Claims{
+		Subject: id.Username, UserID: id.UserID, Roles: id.Roles,
+		Audience: m.Name, Issuer: moduleauth.Issuer,
+		IssuedAt: now.Unix(), Expiry: now.Add(assertionTTL).Unix(),
+	}, m.assertionKey)
+	if err != nil {
+		log.Printf("modules: sign assertion for %s: %v", m.Name, err)
+		return
+	}
+	h.Set(moduleauth.HeaderAssertion, tok)
+}
+
+// ensureAssertionKey создаёт ключ подписи утверждений для модуля, если его
+// ещё нет. Ключ свой у каждого модуля: модуль не может подделать запрос к другому.
+// Вызывается под r.mu.
+func (r *Registry) ensureAssertionKey(m *Module) error {
+	if len(m.assertionKey) > 0 {
+		return nil
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	if _, err := db.DB.Exec(`UPDATE modules SET assertion_key=? WHERE name=?`, hex.EncodeToString(key), m.Name); err != nil {
+		return err
+	}
+	m.assertionKey = key
+	return nil
+}
+
+// rewriteLocation возвращает редирект модуля под префикс портала.
+// Абсолютные пути и URL, указывающие на сам модуль, переписываются;
+// относительные пути и внешние адреса остаются как есть.
+func rewriteLocation(loc, prefix string, out *http.Request) string {
+	u, err := url.Parse(loc)
+	if err != nil {
+		return loc
+	}
+	if u.Host != "" {
+		fwdHost := out.Header.Get("X-Forwarded-Host")
+		if u.Host != out.URL.Host && u.Host != fwdHost && !isLoopback(u.Hostname()) {
+			return loc
+		}
+		u.Scheme, u.Host, u.User = "", "", nil
+	}
+	if !strings.HasPrefix(u.Path, "/") || u.Path == prefix || strings.HasPrefix(u.Path, prefix+"/") {
+		return u.String()
+	}
+	u.Path = prefix + u.Path
+	if u.RawPath != "" {
+		u.RawPath = prefix + u.RawPath
+	}
+	return u.String()
+}
+
+func isLoopback(host string) bool {
+	return host == "localhost" || host == "127.0.0.1" || host == "::1"
+}
@@ -0,0 +1,92 @@
+package modules
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ZenithSolitude/Hopefully/pkg/moduleauth"
+)
+
+func TestRewriteLocation(t *testing.T) {
+	prefix := ProxyPrefix + "demo"
+	out := httptest.NewRequest(http.MethodGet, "http://demo/page", nil)
+	out.Header.Set("X-Forwarded-Host", "portal.example")
+
+	tests := []struct {
+		loc, want string
+	}{
+		{"/login", prefix + "/login"},
+		{"/login?next=%2Fa#top", prefix + "/login?next=%2Fa#top"},
+		{"/", prefix + "/"},
+		{"login", "login"},
+		{"../up", "../up"},
+		{prefix, prefix},
+		{prefix + "/x", prefix + "/x"},
+		{prefix + "x", prefix + prefix + "x"},
+		{"/a%2Fb", prefix + "/a%2Fb"},
+		{"http://127.0.0.1:9200/a?b=1", prefix + "/a?b=1"},
+		{"http://localhost/a", prefix + "/a"},
+		{"http://[::1]:9200/a", prefix + "/a"},
+		{"http://demo/a", prefix + "/a"},
+		{"https://portal.example/a", prefix + "/a"},
+		{"https://sso.example/auth?x=1", "https://sso.example/auth?x=1"},
+		{"//evil.example/a", "//evil.example/a"},
+		{"http://[bad", "http://[bad"},
+	}
+	for _, tt := range tests {
+		if got := rewriteLocation(tt.loc, prefix, out); got != tt.want {
+			t.Errorf("rewriteLocation(%q) = %q, want %q", tt.loc, got, tt.want)
+		}
+	}
+}
+
+// Модуль получает identity портала с подписью своим ключом; присланные
+// браузером X-Hopefully-* не доходят.
+func TestProxyIdentity(t *testing.T) {
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		http.Redirect(w, r, "/done", http.StatusFound)
+	}))
+	defer backend.Close()
+	key := []byte("0123456789abcdef0123456789abcdef")
+	m := &Module{Name: "demo", assertionKey: key}
+	m.setUpstream("tcp", backend.Listener.Addr().String())
+
+	tests := []struct {
+		name string
+		id   Identity
+		user string
+		xff  string
+	}{
+		{"user", Identity{UserID: 7, Username: "alice", Roles: []string{"user", "staff"}}, "alice", "192.0.2.1"},
+		{"anonymous", Identity{}, "", "192.0.2.1"},
+		{"behind trusted proxy", Identity{UserID: 7, Username: "alice", Roles: []string{"staff"}, ClientIP: "203.0.113.9"}, "alice", "203.0.113.9"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, ProxyPrefix+"demo/page", nil)
+		req.Header.Set("X-Forwarded-For", "198.51.100.66")
+		req.Header.Set(moduleauth.HeaderUser, "admin")
+		req.Header.Set(moduleauth.HeaderAssertion, "forged")
+		rec := httptest.NewRecorder()
+		m.ServeProxy(rec, req, tt.id)
+		if loc := rec.Header().Get("Location"); loc != ProxyPrefix+"demo/done" {
+			t.Errorf("%s: Location %q", tt.name, loc)
+		}
+		if got.Get(moduleauth.HeaderUser) != tt.user || got.Get("X-Forwarded-Prefix") != ProxyPrefix+"demo" ||
+			got.Get("X-Forwarded-For") != tt.xff {
+			t.Errorf("%s: headers %v", tt.name, got)
+		}
+		c, err := moduleauth.FromRequest(&http.Request{Header: got}, key, "demo")
+		switch {
+		case tt.user == "" && err != moduleauth.ErrMissing:
+			t.Errorf("%s: assertion passed through: %v", tt.name, err)
+		case tt.user != "" && (err != nil || c.Subject != tt.user || c.UserID != tt.id.UserID || !c.HasRole("staff")):
+			t.Errorf("%s: assertion %+v, %v", tt.name, c, err)
+		case tt.user != "" && time.Unix(c.Expiry, 0).After(time.Now().Add(assertionTTL+time.Second)):
+			t.Errorf("%s: assertion lives too long", tt.name)
+		}
+	}
+}
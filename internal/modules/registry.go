@@ -1,17 +1,23 @@
 package modules
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/ZenithSolitude/Hopefully/internal/db"
+	"github.com/ZenithSolitude/Hopefully/pkg/moduleauth"
 )
 
 type Module struct {
@@ -24,15 +30,26 @@ type Module struct {
 	SourceType  string
 	SourceURL   string
 	Manifest    *Manifest
-	ErrorLog    string
-	InstalledAt time.Time
-	proc        *exec.Cmd
+	ErrorLog     string
+	InstalledAt  time.Time
+	Port         int // фактический порт: из манифеста или выделенный реестром
+	RestartCount int
+	LastExitCode *int
+	proc         *exec.Cmd
+	done         chan struct{} // закрывается, когда процесс завершился
+	quit         chan struct{} // закрывается при остановке — отменяет перезапуски
+	crashes      []time.Time
+	env          []string // окружение процесса — для exec-проверок здоровья
+	up           atomic.Pointer[upstream]
+	assertionKey []byte // ключ подписи X-Hopefully-Assertion
 }
 
 type Registry struct {
 	mu      sync.RWMutex
 	byName  map[string]*Module
 	dataDir string
+	portMin int
+	portMax int
 }
 
 var Default = &Registry{byName: make(map[string]*Module)}
@@ -45,33 +62,44 @@ func (r *Registry) Setup(dataDir string) {
 func (r *Registry) modulesDir() string { return filepath.Join(r.dataDir, "modules") }
 func (r *Registry) moduleDir(n string) string { return filepath.Join(r.modulesDir(), n) }
 
+// LoadFromDB читает установленные модули и поднимает те, что работали.
+// Модули запускаются после того, как курсор закрыт: startProcess пишет в БД,
+// а соединение с ней одно.
 func (r *Registry) LoadFromDB() {
 	rows, err := db.DB.Query(
-		`SELECT id,name,version,description,author,status,source_type,source_url,manifest,error_log,installed_at FROM modules ORDER BY name`)
+		`SELECT id,name,version,description,author,status,source_type,source_url,manifest,error_log,installed_at,restart_count,last_exit_code,port,assertion_key FROM modules ORDER BY name`)
 	if err != nil {
 		log.Printf("modules load: %v", err)
 		return
 	}
-	defer rows.Close()
+	var loaded []*Module
 	for rows.Next() {
 		m := &Module{}
-		var mj, ia string
-		rows.Scan(&m.ID,&m.Name,&m.Version,&m.Description,&m.Author,&m.Status,&m.SourceType,&m.SourceURL,&mj,&m.ErrorLog,&ia)
+		var mj, ia, key string
+		rows.Scan(&m.ID,&m.Name,&m.Version,&m.Description,&m.Author,&m.Status,&m.SourceType,&m.SourceURL,&mj,&m.ErrorLog,&ia,&m.RestartCount,&m.LastExitCode,&m.Port,&key)
+		m.assertionKey, _ = hex.DecodeString(key)
 		t, _ := time.Parse("2006-01-02 15:04:05", ia)
 		m.InstalledAt = t
 		var mf Manifest
 		if json.Unmarshal([]byte(mj), &mf) == nil {
 			m.Manifest = &mf
 		}
-		r.mu.Lock()
+		loaded = append(loaded, m)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		log.Printf("modules load: %v", err)
+	}
+	r.mu.Lock()
+	for _, m := range loaded {
 		r.byName[m.Name] = m
-		r.mu.Unlock()
-		if m.Status == "active" {
+	}
+	r.mu.Unlock()
+	for _, m := range loaded {
+		if IsRunning(m.Status) {
 			if err := r.startProcess(m); err != nil {
 				log.Printf("autostart %s: %v", m.Name, err)
-				m.Status = "error"
-				m.ErrorLog = err.Error()
-				db.DB.Exec(`UPDATE modules SET status='error',error_log=? WHERE name=?`, err.Error(), m.Name)
 			}
 		}
 	}
@@ -101,14 +129,19 @@ type NavItem struct {
 	Icon     string
 	Href     string
 	Position int
+	Status   string
 }
 
-func (r *Registry) NavItems() []NavItem {
+// NavItems — пункты меню запущенных модулей, доступных пользователю (allow).
+func (r *Registry) NavItems(allow func(*Module) bool) []NavItem {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 	var items []NavItem
 	for _, m := range r.byName {
-		if m.Status != "active" || m.Manifest == nil || m.Manifest.Menu.Hidden {
+		if !(IsServing(m.Status) || m.Status == "starting") || m.Manifest == nil || m.Manifest.Menu.Hidden {
+			continue
+		}
+		if !allow(m) {
 			continue
 		}
 		label := m.Manifest.Menu.Label
@@ -119,6 +152,7 @@ func (r *Registry) NavItems() []NavItem {
 		items = append(items, NavItem{
 			Name: m.Name, Label: label, Icon: icon,
 			Href: "/modules/" + m.Name, Position: m.Manifest.Menu.Position,
+			Status: m.Status,
 		})
 	}
 	sort.Slice(items, func(i, j int) bool {
@@ -130,33 +164,38 @@ func (r *Registry) NavItems() []NavItem {
 	return items
 }
 
+// Permissions — права, которые требует модуль (из manifest.json).
+func (m *Module) Permissions() []string {
+	if m.Manifest == nil {
+		return nil
+	}
+	return m.Manifest.Permissions
+}
+
 func (r *Registry) Activate(name string) error {
-	r.mu.Lock()
+	r.mu.RLock()
 	m, ok := r.byName[name]
-	r.mu.Unlock()
+	r.mu.RUnlock()
 	if !ok {
 		return fmt.Errorf("module %q not found", name)
 	}
-	if m.Manifest != nil && m.Manifest.Entrypoint != "" {
-		if err := r.startProcess(m); err != nil {
-			db.DB.Exec(`UPDATE modules SET status='error',error_log=? WHERE name=?`, err.Error(), name)
-			m.Status = "error"; m.ErrorLog = err.Error()
-			return err
-		}
-	}
-	m.Status = "active"; m.ErrorLog = ""
-	db.DB.Exec(`UPDATE modules SET status='active',error_log='' WHERE name=?`, name)
-	return nil
+	r.stopProcess(m)
+	r.mu.Lock()
+	m.RestartCount = 0
+	r.mu.Unlock()
+	return r.startProcess(m)
 }
 
 func (r *Registry) Deactivate(name string) {
-	r.mu.Lock()
+	r.mu.RLock()
 	m, ok := r.byName[name]
-	r.mu.Unlock()
+	r.mu.RUnlock()
 	if !ok { return }
 	r.stopProcess(m)
-	m.Status = "inactive"
-	db.DB.Exec(`UPDATE modules SET status='inactive' WHERE name=?`, name)
+	r.mu.Lock()
+	m.Status = "inactive"; m.ErrorLog = ""
+	r.saveState(m)
+	r.mu.Unlock()
 }
 
 func (r *Registry) Delete(name string) error {
@@ -168,8 +207,37 @@ func (r *Registry) Delete(name string) error {
 	return os.RemoveAll(r.moduleDir(name))
 }
 
+// startProcess запускает модуль и ставит его под надзор supervise.
+// Статус и ошибка запуска сохраняются в БД здесь же.
 func (r *Registry) startProcess(m *Module) error {
-	if m.Manifest == nil || m.Manifest.Entrypoint == "" { return nil }
+	r.mu.Lock()
+	m.crashes = nil
+	m.quit = make(chan struct{})
+	err := r.assignPort(m)
+	if err == nil {
+		err = r.ensureAssertionKey(m)
+	}
+	if err == nil {
+		err = r.spawn(m, m.quit)
+	}
+	if err != nil {
+		m.Status = "error"; m.ErrorLog = err.Error()
+	}
+	r.saveState(m)
+	// Без healthcheck судить о готовности не по чему — даём процессу чуть времени.
+	settle := m.proc != nil && m.Status == "active"
+	r.mu.Unlock()
+	if err != nil { return err }
+	if settle { time.Sleep(300 * time.Millisecond) }
+	return nil
+}
+
+// spawn стартует процесс entrypoint и выставляет начальный статус. Вызывается под r.mu.
+func (r *Registry) spawn(m *Module, quit chan struct{}) error {
+	if m.Manifest == nil || m.Manifest.Entrypoint == "" {
+		m.Status = "active"; m.ErrorLog = ""
+		return nil
+	}
 	dir := r.moduleDir(m.Name)
 	entry := filepath.Join(dir, m.Manifest.Entrypoint)
 	if _, err := os.Stat(entry); err != nil {
@@ -179,14 +247,26 @@ func (r *Registry) startProcess(m *Module) error {
 	args := append([]string{entry}, m.Manifest.Args...)
 	cmd := exec.Command(args[0], args[1:]...)
 	cmd.Dir = dir
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true} // своя группа: останавливаем вместе с детьми
 	cmd.Env = append(os.Environ(),
 		"MODULE_NAME="+m.Name,
 		"MODULE_DIR="+dir,
 		"DATA_DIR="+filepath.Join(r.dataDir, "module_data", m.Name),
+		moduleauth.EnvKey+"="+hex.EncodeToString(m.assertionKey),
 	)
-	if m.Manifest.Port != 0 {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("PORT=%d", m.Manifest.Port))
+	var network, addr, sock string
+	if m.Manifest.listen() == ListenUnix {
+		var err error
+		if sock, err = r.prepareSocket(m); err != nil {
+			return fmt.Errorf("socket: %w", err)
+		}
+		network, addr = "unix", sock
+		cmd.Env = append(cmd.Env, "SOCKET_PATH="+sock)
+	} else if m.Port != 0 {
+		network, addr = "tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(m.Port))
+		cmd.Env = append(cmd.Env, fmt.Sprintf("PORT=%d", m.Port))
 	}
+	m.setUpstream(network, addr)
 	for k, v := range m.Manifest.Env {
 		cmd.Env = append(cmd.Env, k+"="+v)
 	}
@@ -194,32 +274,58 @@ func (r *Registry) startProcess(m *Module) error {
 	os.MkdirAll(filepath.Dir(lp), 0755)
 	if lf, err := os.OpenFile(lp, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644); err == nil {
 		cmd.Stdout = lf; cmd.Stderr = lf
+		defer lf.Close()
 	}
 	if err := cmd.Start(); err != nil {
 		return fmt.Errorf("start: %w", err)
 	}
-	m.proc = cmd
+	done := make(chan struct{})
+	m.proc, m.done, m.env = cmd, done, cmd.Env
+	m.Status = m.Manifest.initialStatus(); m.ErrorLog = ""
 	log.Printf("modules: started %s (pid %d)", m.Name, cmd.Process.Pid)
-	go func() {
-		cmd.Wait()
-		log.Printf("modules: %s exited", m.Name)
-		r.mu.Lock()
-		if mod, ok := r.byName[m.Name]; ok && mod.Status == "active" {
-			mod.Status = "error"
-			mod.ErrorLog = "process exited unexpectedly"
-			db.DB.Exec(`UPDATE modules SET status='error',error_log='process exited unexpectedly' WHERE name=?`, m.Name)
-		}
-		r.mu.Unlock()
-	}()
-	time.Sleep(300 * time.Millisecond)
+	go r.supervise(m, cmd, done, quit)
+	if sock != "" {
+		go secureSocket(m.Name, sock, done)
+	}
+	if m.Manifest.Healthcheck != nil {
+		go r.watchHealth(m, cmd, done, quit)
+	}
 	return nil
 }
 
+// stopProcess отменяет надзор и останавливает процесс: SIGTERM группе и
+// ожидание, пока завершатся все её процессы, а не только entrypoint; кто не
+// успел за stop_timeout — SIGKILL (см. stopGroup).
 func (r *Registry) stopProcess(m *Module) {
-	if m.proc == nil || m.proc.Process == nil { return }
-	m.proc.Process.Kill()
-	m.proc.Wait()
-	m.proc = nil
+	r.mu.Lock()
+	if m.quit != nil { close(m.quit); m.quit = nil }
+	cmd, done := m.proc, m.done
+	m.proc, m.done = nil, nil
+	r.mu.Unlock()
+	if cmd == nil || cmd.Process == nil { return }
+	stopGroup(m.Name, cmd.Process.Pid, m.Manifest.stopTimeout())
+	<-done
+	if u := m.up.Load(); u != nil {
+		u.transport.CloseIdleConnections()
+	}
+	log.Printf("modules: stopped %s", m.Name)
+}
+
+// StopAll останавливает процессы всех модулей при выключении сервера.
+// Статусы в БД не меняются — при следующем запуске модули поднимутся снова.
+func (r *Registry) StopAll() {
+	var wg sync.WaitGroup
+	for _, m := range r.All() {
+		wg.Add(1)
+		go func(m *Module) { defer wg.Done(); r.stopProcess(m) }(m)
+	}
+	wg.Wait()
+}
+
+// saveState пишет в БД статус и счётчики перезапусков. Вызывается под r.mu.
+func (r *Registry) saveState(m *Module) {
+	db.DB.Exec(`UPDATE modules SET status=?,error_log=?,restart_count=?,last_exit_code=? WHERE name=?`,
+		m.Status, m.ErrorLog, m.RestartCount, m.LastExitCode, m.Name)
 }
 
 func (r *Registry) register(m *Module) {
@@ -230,10 +336,13 @@ func (r *Registry) register(m *Module) {
 		ON CONFLICT(name) DO UPDATE SET
 			version=excluded.version,description=excluded.description,author=excluded.author,
 			source_type=excluded.source_type,source_url=excluded.source_url,
-			manifest=excluded.manifest,status='inactive',error_log=''`,
+			manifest=excluded.manifest,status='inactive',error_log='',
+			restart_count=0,last_exit_code=NULL`,
 		m.Name,m.Version,m.Description,m.Author,m.SourceType,m.SourceURL,string(mj),
 	)
-	db.DB.QueryRow(`SELECT id FROM modules WHERE name=?`, m.Name).Scan(&m.ID)
+	var key string
+	db.DB.QueryRow(`SELECT id,port,assertion_key FROM modules WHERE name=?`, m.Name).Scan(&m.ID, &m.Port, &key)
+	m.assertionKey, _ = hex.DecodeString(key)
 	r.mu.Lock()
 	r.byName[m.Name] = m
 	r.mu.Unlock()
@@ -0,0 +1,98 @@
+package modules
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ZenithSolitude/Hopefully/internal/db"
+)
+
+// newTestRegistry — реестр с чистой базой во временном каталоге.
+func newTestRegistry(t *testing.T) *Registry {
+	t.Helper()
+	dir := t.TempDir()
+	if err := db.Init(filepath.Join(dir, "data")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.DB.Close() })
+	r := &Registry{byName: make(map[string]*Module)}
+	r.Setup(dir)
+	return r
+}
+
+// Работавшие модули поднимаются при загрузке; пока открыт курсор, запись в
+// БД из startProcess ждала бы единственное соединение вечно.
+func TestLoadFromDBStartsRunning(t *testing.T) {
+	r := newTestRegistry(t)
+	for _, st := range []struct{ name, status string }{{"a", "active"}, {"b", "inactive"}, {"c", "healthy"}} {
+		if _, err := db.DB.Exec(`INSERT INTO modules (name, status, manifest) VALUES (?, ?, '{}')`, st.name, st.status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	loaded := make(chan struct{})
+	go func() { r.LoadFromDB(); close(loaded) }()
+	select {
+	case <-loaded:
+	case <-time.After(10 * time.Second):
+		t.Fatal("LoadFromDB did not return")
+	}
+	want := map[string]string{"a": "active", "b": "inactive", "c": "active"}
+	for name, status := range want {
+		m, ok := r.Get(name)
+		if !ok || m.Status != status {
+			t.Errorf("%s: %+v, want status %s", name, m, status)
+		}
+		if status == "active" && len(m.assertionKey) == 0 {
+			t.Errorf("%s: assertion key not created", name)
+		}
+	}
+}
+
+// addModule регистрирует модуль, entrypoint которого — shell-скрипт script.
+func addModule(t *testing.T, r *Registry, name string, mf Manifest, script string) *Module {
+	t.Helper()
+	dir := r.moduleDir(name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if script != "" {
+		if err := os.WriteFile(filepath.Join(dir, "run.sh"), []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		mf.Entrypoint = "run.sh"
+	}
+	mf.Name, mf.Version = name, "1.0.0"
+	m := &Module{Name: name, Version: mf.Version, Manifest: &mf}
+	r.register(m)
+	t.Cleanup(func() { r.stopProcess(m) })
+	return m
+}
+
+// moduleState — снимок полей модуля, которые меняет supervise.
+type moduleState struct {
+	Status, ErrorLog string
+	RestartCount     int
+	LastExitCode     *int
+	Port             int
+}
+
+// waitStatus ждёт, пока модуль перейдёт в статус want, и возвращает его
+// состояние на этот момент.
+func waitStatus(t *testing.T, r *Registry, m *Module, want string, timeout time.Duration) moduleState {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		r.mu.RLock()
+		st := moduleState{Status: m.Status, ErrorLog: m.ErrorLog, RestartCount: m.RestartCount, LastExitCode: m.LastExitCode, Port: m.Port}
+		r.mu.RUnlock()
+		if st.Status == want {
+			return st
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: status %q (%s), want %q", m.Name, st.Status, st.ErrorLog, want)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
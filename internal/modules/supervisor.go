@@ -0,0 +1,190 @@
+package modules
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// Политики перезапуска процесса модуля (поле "restart" в manifest.json).
+const (
+	RestartAlways    = "always"
+	RestartOnFailure = "on-failure"
+	RestartNever     = "never"
+)
+
+const (
+	defaultMaxRetries  = 5
+	defaultRetryWindow = 60 * time.Second
+	defaultStopTimeout = 10 * time.Second
+	backoffBase        = time.Second
+	backoffMax         = time.Minute
+	groupPollInterval  = 100 * time.Millisecond
+)
+
+// IsRunning — статус, при котором процесс модуля запущен или будет перезапущен.
+func IsRunning(status string) bool {
+	return IsServing(status) || status == "starting" || status == "restarting"
+}
+
+// supervise ждёт завершения процесса и применяет политику перезапуска.
+// quit закрывается в stopProcess — значит, остановка была намеренной.
+func (r *Registry) supervise(m *Module, cmd *exec.Cmd, done, quit chan struct{}) {
+	code := exitCode(cmd.Wait())
+	select {
+	case <-quit:
+		// Группу останавливает stopProcess: дети ещё могут завершаться после SIGTERM.
+		close(done)
+		return
+	default:
+	}
+	log.Printf("modules: %s exited (code %d)", m.Name, code)
+	// Дети entrypoint могли пережить его и держать порт — останавливаем группу
+	// так же, как при остановке модуля, прежде чем перезапускать.
+	stopGroup(m.Name, cmd.Process.Pid, m.Manifest.stopTimeout())
+	close(done)
+
+	r.mu.Lock()
+	if m.proc == cmd {
+		m.proc, m.done = nil, nil
+	}
+	m.LastExitCode = &code
+	policy := m.Manifest.restartPolicy()
+	if policy == RestartNever || (policy == RestartOnFailure && code == 0) {
+		if code == 0 {
+			m.Status = "inactive"
+			m.ErrorLog = "process exited (code 0)"
+		} else {
+			m.Status = "error"
+			m.ErrorLog = fmt.Sprintf("process exited with code %d", code)
+		}
+		r.saveState(m)
+		r.mu.Unlock()
+		return
+	}
+
+	// Падения старше окна забываем: модуль, проработавший дольше retry_window,
+	// снова начинает с минимальной задержки.
+	now := time.Now()
+	window := m.Manifest.retryWindow()
+	recent := m.crashes[:0]
+	for _, t := range m.crashes {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	m.crashes = append(recent, now)
+	if len(m.crashes) > m.Manifest.maxRetries() {
+		m.Status = "crashloop"
+		m.ErrorLog = fmt.Sprintf("crash loop: %d exits within %s, last exit code %d", len(m.crashes), window, code)
+		log.Printf("modules: %s parked in crashloop", m.Name)
+		r.saveState(m)
+		r.mu.Unlock()
+		return
+	}
+	delay := backoff(len(m.crashes))
+	m.Status = "restarting"
+	m.ErrorLog = fmt.Sprintf("process exited with code %d, restarting in %s", code, delay)
+	r.saveState(m)
+	r.mu.Unlock()
+
+	select {
+	case <-quit:
+		return
+	case <-time.After(delay):
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	select {
+	case <-quit:
+		return
+	default:
+	}
+	// Порт могли занять, пока модуль лежал: проверяем его, как при первом запуске.
+	err := r.assignPort(m)
+	if err == nil {
+		err = r.spawn(m, quit)
+	}
+	if err != nil {
+		log.Printf("modules: restart %s: %v", m.Name, err)
+		m.Status = "error"
+		m.ErrorLog = err.Error()
+		r.saveState(m)
+		return
+	}
+	m.RestartCount++
+	r.saveState(m)
+}
+
+// stopGroup шлёт группе процессов pgid SIGTERM и ждёт, пока в ней никого не
+// останется, не дольше timeout; оставшимся — SIGKILL. Опустевшую группу больше
+// не трогает: её номер может достаться новому процессу.
+func stopGroup(name string, pgid int, timeout time.Duration) {
+	if syscall.Kill(-pgid, syscall.SIGTERM) != nil {
+		return // группа уже пуста
+	}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(groupPollInterval)
+		if syscall.Kill(-pgid, 0) != nil {
+			return
+		}
+	}
+	log.Printf("modules: %s did not stop within %s, killing", name, timeout)
+	syscall.Kill(-pgid, syscall.SIGKILL)
+}
+
+// backoff — экспоненциальная задержка перед n-м перезапуском подряд.
+func backoff(n int) time.Duration {
+	d := backoffBase
+	for i := 1; i < n && d < backoffMax; i++ {
+		d *= 2
+	}
+	if d > backoffMax {
+		d = backoffMax
+	}
+	return d
+}
+
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		return ee.ExitCode()
+	}
+	return -1
+}
+
+func (mf *Manifest) restartPolicy() string {
+	if mf == nil || mf.Restart == "" {
+		return RestartOnFailure
+	}
+	return mf.Restart
+}
+
+func (mf *Manifest) maxRetries() int {
+	if mf == nil || mf.MaxRetries <= 0 {
+		return defaultMaxRetries
+	}
+	return mf.MaxRetries
+}
+
+func (mf *Manifest) retryWindow() time.Duration {
+	if mf == nil || mf.RetryWindow <= 0 {
+		return defaultRetryWindow
+	}
+	return time.Duration(mf.RetryWindow) * time.Second
+}
+
+func (mf *Manifest) stopTimeout() time.Duration {
+	if mf == nil || mf.StopTimeout <= 0 {
+		return defaultStopTimeout
+	}
+	return time.Duration(mf.StopTimeout) * time.Second
+}
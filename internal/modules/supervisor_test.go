@@ -0,0 +1,140 @@
+package modules
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ZenithSolitude/Hopefully/internal/db"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		n    int
+		want time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{6, 32 * time.Second},
+		{7, time.Minute},
+		{50, time.Minute},
+	}
+	for _, tt := range tests {
+		if got := backoff(tt.n); got != tt.want {
+			t.Errorf("backoff(%d) = %s, want %s", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestExitPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		restart string
+		script  string
+		status  string
+		code    int
+	}{
+		{"never, failure", RestartNever, "exit 3", "error", 3},
+		{"never, success", RestartNever, "exit 0", "inactive", 0},
+		{"on-failure, success", RestartOnFailure, "exit 0", "inactive", 0},
+		{"default, success", "", "exit 0", "inactive", 0},
+	}
+	r := newTestRegistry(t)
+	for i, tt := range tests {
+		m := addModule(t, r, "policy"+string(rune('a'+i)), Manifest{Restart: tt.restart}, tt.script)
+		if err := r.Activate(m.Name); err != nil {
+			t.Fatal(err)
+		}
+		st := waitStatus(t, r, m, tt.status, 5*time.Second)
+		if st.LastExitCode == nil || *st.LastExitCode != tt.code || st.RestartCount != 0 {
+			t.Errorf("%s: exit code %v, restarts %d", tt.name, st.LastExitCode, st.RestartCount)
+		}
+	}
+}
+
+// Падающий модуль перезапускается с задержкой, а после max_retries падений
+// в окне паркуется в crashloop и больше не поднимается.
+func TestCrashLoop(t *testing.T) {
+	r := newTestRegistry(t)
+	m := addModule(t, r, "flaky", Manifest{Restart: RestartAlways, MaxRetries: 1}, "exit 7")
+	if err := r.Activate(m.Name); err != nil {
+		t.Fatal(err)
+	}
+	st := waitStatus(t, r, m, "restarting", 5*time.Second)
+	if !strings.Contains(st.ErrorLog, "restarting in 1s") {
+		t.Errorf("first crash: %q", st.ErrorLog)
+	}
+	st = waitStatus(t, r, m, "crashloop", 5*time.Second)
+	if st.RestartCount != 1 || *st.LastExitCode != 7 {
+		t.Fatalf("crashloop: restarts %d, exit code %d", st.RestartCount, *st.LastExitCode)
+	}
+	var status string
+	var restarts int
+	db.DB.QueryRow(`SELECT status, restart_count FROM modules WHERE name = ?`, m.Name).Scan(&status, &restarts)
+	if status != "crashloop" || restarts != 1 {
+		t.Fatalf("saved state: %s, %d restarts", status, restarts)
+	}
+
+	// Ручная активация начинает счёт заново
+	if err := r.Activate(m.Name); err != nil {
+		t.Fatal(err)
+	}
+	if st := waitStatus(t, r, m, "restarting", 5*time.Second); st.RestartCount != 0 {
+		t.Fatalf("after activate: %d restarts", st.RestartCount)
+	}
+}
+
+// Остановка ждёт всю группу процессов: ребёнок, переживший entrypoint,
+// получает SIGTERM, а кто его игнорирует — SIGKILL по stop_timeout.
+func TestStopGroup(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		min    time.Duration
+	}{
+		{"exits on SIGTERM", "sleep 60 &\nwait", 0},
+		{"ignores SIGTERM", "trap '' TERM\nsh -c \"trap '' TERM; sleep 60\" &\nwait", time.Second},
+	}
+	r := newTestRegistry(t)
+	for i, tt := range tests {
+		m := addModule(t, r, "group"+string(rune('a'+i)), Manifest{StopTimeout: 1}, "echo $$ > pid\n"+tt.script)
+		if err := r.Activate(m.Name); err != nil {
+			t.Fatal(err)
+		}
+		pgid := readPID(t, filepath.Join(r.moduleDir(m.Name), "pid"))
+		start := time.Now()
+		r.Deactivate(m.Name)
+		took := time.Since(start)
+		if took < tt.min || took > tt.min+3*time.Second {
+			t.Errorf("%s: stop took %s", tt.name, took)
+		}
+		// Осиротевших детей ещё должен подобрать init — даём ему время
+		gone := false
+		for i := 0; i < 100 && !gone; i++ {
+			gone = syscall.Kill(-pgid, 0) != nil
+			time.Sleep(20 * time.Millisecond)
+		}
+		if !gone {
+			t.Errorf("%s: process group %d still alive", tt.name, pgid)
+		}
+	}
+}
+
+func readPID(t *testing.T, path string) int {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		b, _ := os.ReadFile(path)
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil && strings.HasSuffix(string(b), "\n") {
+			return pid
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("%s not written", path)
+	return 0
+}
@@ -0,0 +1,111 @@
+package modules
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Способы, которыми модуль принимает HTTP (поле "listen" в manifest.json).
+const (
+	ListenTCP  = "tcp"  // 127.0.0.1:PORT
+	ListenUnix = "unix" // сокет SOCKET_PATH в каталоге данных модуля
+)
+
+const socketName = "http.sock"
+
+func (mf *Manifest) listen() string {
+	if mf == nil || mf.Listen == "" {
+		return ListenTCP
+	}
+	return mf.Listen
+}
+
+// upstream — куда проксировать HTTP модуля. Заменяется целиком при каждом
+// запуске процесса и читается без r.mu: прокси и проверки здоровья не ждут реестр.
+type upstream struct {
+	network   string
+	addr      string
+	transport *http.Transport
+}
+
+// setUpstream ставит адрес нового процесса (пустой network — модуль без HTTP)
+// и закрывает простаивающие соединения к прежнему: его порт или сокет уже мёртв.
+func (m *Module) setUpstream(network, addr string) {
+	var next *upstream
+	if network != "" {
+		next = &upstream{network: network, addr: addr, transport: newTransport(network, addr)}
+	}
+	if prev := m.up.Swap(next); prev != nil {
+		prev.transport.CloseIdleConnections()
+	}
+}
+
+// upstream — адрес, на котором модуль принимает HTTP. Пустой network — модуль без HTTP.
+func (m *Module) upstream() (network, addr string) {
+	if u := m.up.Load(); u != nil {
+		return u.network, u.addr
+	}
+	return "", ""
+}
+
+// HasUpstream — модуль поднимает HTTP-сервер, который можно проксировать.
+func (m *Module) HasUpstream() bool { return m.up.Load() != nil }
+
+// Transport — HTTP-транспорт до модуля. Для unix-сокета хост в URL запроса
+// не важен: соединение всегда идёт в сокет.
+func (m *Module) Transport() http.RoundTripper {
+	if u := m.up.Load(); u != nil {
+		return u.transport
+	}
+	return http.DefaultTransport
+}
+
+func newTransport(network, addr string) *http.Transport {
+	var d net.Dialer
+	return &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return d.DialContext(ctx, network, addr)
+		},
+		MaxIdleConns:    16,
+		IdleConnTimeout: 90 * time.Second,
+	}
+}
+
+// prepareSocket готовит каталог данных (0700) и убирает сокет, оставшийся
+// от прошлого запуска. Возвращает путь для SOCKET_PATH.
+func (r *Registry) prepareSocket(m *Module) (string, error) {
+	dir := filepath.Join(r.dataDir, "module_data", m.Name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, socketName)
+	os.Remove(path)
+	return path, nil
+}
+
+// secureSocket ждёт, пока модуль создаст сокет, и закрывает его от других
+// пользователей: umask процесса модуля может оставить его открытым на запись.
+func secureSocket(name, path string, done chan struct{}) {
+	for i := 0; i < 150; i++ {
+		select {
+		case <-done:
+			return
+		case <-time.After(200 * time.Millisecond):
+		}
+		if _, err := os.Stat(path); err == nil {
+			if err := os.Chmod(path, 0600); err != nil {
+				log.Printf("modules: %s: chmod socket: %v", name, err)
+			}
+			return
+		}
+	}
+	log.Printf("modules: %s did not create %s", name, path)
+}
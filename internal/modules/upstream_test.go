@@ -0,0 +1,47 @@
+package modules
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// Перезапуск подменяет адрес модуля, пока прокси им пользуется; под -race
+// здесь не должно быть гонки.
+func TestSetUpstreamConcurrent(t *testing.T) {
+	m := &Module{Name: "demo"}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			if i%2 == 0 {
+				m.setUpstream("tcp", "127.0.0.1:9200")
+			} else {
+				m.setUpstream("unix", "/tmp/demo.sock")
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			if m.HasUpstream() && m.Transport() == nil {
+				t.Error("nil transport")
+			}
+			m.upstream()
+		}
+	}()
+	wg.Wait()
+}
+
+func TestSetUpstreamNone(t *testing.T) {
+	m := &Module{Name: "static"}
+	m.setUpstream("tcp", "127.0.0.1:9200")
+	m.setUpstream("", "")
+	if m.HasUpstream() {
+		t.Fatal("module without HTTP still has an upstream")
+	}
+	if m.Transport() != http.DefaultTransport {
+		t.Fatal("expected the default transport")
+	}
+}
@@ -0,0 +1,177 @@
+// Package moduleauth проверяет, от имени какого пользователя Hopefully пришёл
+// запрос в модуль.
+//
+// Портал проксирует модуль через /module-proxy/<name>/, вырезает свою cookie
+// сессии и добавляет заголовки X-Hopefully-User, X-Hopefully-Roles и
+// X-Hopefully-Assertion. Первые два — для удобства; доверять можно только
+// Assertion — короткоживущему JWT (HS256), подписанному ключом модуля из
+// переменной окружения HOPEFULLY_ASSERTION_KEY:
+//
+//	key, _ := moduleauth.KeyFromEnv()
+//	http.Handle("/", moduleauth.Middleware(key, "my-module", handler))
+//
+//	func handler(w http.ResponseWriter, r *http.Request) {
+//		c := moduleauth.FromContext(r.Context())
+//		if !c.HasRole("admin") { ... }
+//	}
+//
+// Пакет использует только стандартную библиотеку.
+package moduleauth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Заголовки, которые портал передаёт модулю.
+const (
+	HeaderUser      = "X-Hopefully-User"
+	HeaderRoles     = "X-Hopefully-Roles"
+	HeaderAssertion = "X-Hopefully-Assertion"
+)
+
+// EnvKey — переменная окружения с ключом модуля (hex).
+const EnvKey = "HOPEFULLY_ASSERTION_KEY"
+
+// Issuer — значение iss в подписанных порталом утверждениях.
+const Issuer = "hopefully"
+
+// Допуск на расхождение часов при проверке exp/iat.
+const leeway = 5 * time.Second
+
+var (
+	ErrMissing   = errors.New("moduleauth: no assertion")
+	ErrMalformed = errors.New("moduleauth: malformed assertion")
+	ErrSignature = errors.New("moduleauth: bad signature")
+	ErrExpired   = errors.New("moduleauth: assertion expired")
+	ErrAudience  = errors.New("moduleauth: assertion issued for another module")
+)
+
+// Claims — содержимое утверждения.
+type Claims struct {
+	Subject  string   `json:"sub"` // логин пользователя
+	UserID   int64    `json:"uid"`
+	Roles    []string `json:"roles"`
+	Audience string   `json:"aud"` // имя модуля
+	Issuer   string   `json:"iss"`
+	IssuedAt int64    `json:"iat"`
+	Expiry   int64    `json:"exp"`
+}
+
+// HasRole сообщает, есть ли у пользователя роль.
+func (c *Claims) HasRole(role string) bool {
+	for _, r := range c.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+var header = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// Sign подписывает утверждение ключом модуля. Используется порталом.
+func Sign(c Claims, key []byte) (string, error) {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	signing := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signing + "." + base64.RawURLEncoding.EncodeToString(mac(signing, key)), nil
+}
+
+// Verify проверяет подпись, срок действия и то, что утверждение выпущено
+// для модуля audience.
+func Verify(token string, key []byte, audience string) (*Claims, error) {
+	if token == "" {
+		return nil, ErrMissing
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	var h struct {
+		Alg string `json:"alg"`
+	}
+	hb, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(hb, &h) != nil || h.Alg != "HS256" {
+		return nil, ErrMalformed
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	if !hmac.Equal(sig, mac(parts[0]+"."+parts[1], key)) {
+		return nil, ErrSignature
+	}
+	pb, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	var c Claims
+	if err := json.Unmarshal(pb, &c); err != nil {
+		return nil, ErrMalformed
+	}
+	now := time.Now()
+	if c.Issuer != Issuer {
+		return nil, ErrMalformed
+	}
+	if now.After(time.Unix(c.Expiry, 0).Add(leeway)) || now.Add(leeway).Before(time.Unix(c.IssuedAt, 0)) {
+		return nil, ErrExpired
+	}
+	if c.Audience != audience {
+		return nil, ErrAudience
+	}
+	return &c, nil
+}
+
+// FromRequest проверяет заголовок X-Hopefully-Assertion запроса.
+func FromRequest(r *http.Request, key []byte, audience string) (*Claims, error) {
+	return Verify(r.Header.Get(HeaderAssertion), key, audience)
+}
+
+// KeyFromEnv читает ключ модуля из HOPEFULLY_ASSERTION_KEY.
+func KeyFromEnv() ([]byte, error) {
+	v := os.Getenv(EnvKey)
+	if v == "" {
+		return nil, fmt.Errorf("moduleauth: %s is not set", EnvKey)
+	}
+	return hex.DecodeString(v)
+}
+
+type ctxKey struct{}
+
+// Middleware пропускает только запросы с действительным утверждением,
+// остальным отвечает 401. Claims доступны через FromContext.
+func Middleware(key []byte, audience string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := FromRequest(r, key, audience)
+		if err != nil {
+			http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxKey{}, c)))
+	})
+}
+
+// FromContext возвращает Claims, положенные Middleware, или nil.
+func FromContext(ctx context.Context) *Claims {
+	c, _ := ctx.Value(ctxKey{}).(*Claims)
+	return c
+}
+
+func mac(s string, key []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
@@ -0,0 +1,93 @@
+package moduleauth
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	key := []byte("module-key")
+	now := time.Now()
+	valid := Claims{Subject: "alice", UserID: 7, Roles: []string{"user"}, Audience: "demo", Issuer: Issuer,
+		IssuedAt: now.Unix(), Expiry: now.Add(time.Minute).Unix()}
+	sign := func(edit func(*Claims)) string {
+		c := valid
+		if edit != nil {
+			edit(&c)
+		}
+		tok, err := Sign(c, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok
+	}
+	good := sign(nil)
+	parts := strings.Split(good, ".")
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + parts[1] + "."
+
+	tests := []struct {
+		name string
+		tok  string
+		key  []byte
+		aud  string
+		err  error
+	}{
+		{"valid", good, key, "demo", nil},
+		{"within leeway", sign(func(c *Claims) { c.Expiry = now.Add(-2 * time.Second).Unix() }), key, "demo", nil},
+		{"empty", "", key, "demo", ErrMissing},
+		{"two parts", parts[0] + "." + parts[1], key, "demo", ErrMalformed},
+		{"alg none", none, key, "demo", ErrMalformed},
+		{"bad signature encoding", parts[0] + "." + parts[1] + ".***", key, "demo", ErrMalformed},
+		{"other key", good, []byte("other"), "demo", ErrSignature},
+		{"tampered payload", parts[0] + "." + strings.Split(sign(func(c *Claims) { c.Subject = "admin" }), ".")[1] + "." + parts[2], key, "demo", ErrSignature},
+		{"other issuer", sign(func(c *Claims) { c.Issuer = "someone" }), key, "demo", ErrMalformed},
+		{"expired", sign(func(c *Claims) { c.Expiry = now.Add(-time.Minute).Unix() }), key, "demo", ErrExpired},
+		{"issued in the future", sign(func(c *Claims) { c.IssuedAt = now.Add(time.Minute).Unix() }), key, "demo", ErrExpired},
+		{"other module", good, key, "billing", ErrAudience},
+	}
+	for _, tt := range tests {
+		c, err := Verify(tt.tok, tt.key, tt.aud)
+		if err != tt.err {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err == nil && (c.Subject != "alice" || !c.HasRole("user") || c.HasRole("admin")) {
+			t.Errorf("%s: claims %+v", tt.name, c)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	key := []byte("module-key")
+	tok, _ := Sign(Claims{Subject: "alice", Audience: "demo", Issuer: Issuer,
+		IssuedAt: time.Now().Unix(), Expiry: time.Now().Add(time.Minute).Unix()}, key)
+	h := Middleware(key, "demo", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(FromContext(r.Context()).Subject))
+	}))
+	tests := []struct {
+		name, assertion, user string
+		code                  int
+	}{
+		{"assertion", tok, "", http.StatusOK},
+		{"only user header", "", "alice", http.StatusUnauthorized},
+		{"forged", "x.y.z", "alice", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.assertion != "" {
+			req.Header.Set(HeaderAssertion, tt.assertion)
+		}
+		if tt.user != "" {
+			req.Header.Set(HeaderUser, tt.user)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.code || (tt.code == http.StatusOK && rec.Body.String() != "alice") {
+			t.Errorf("%s: %d %q", tt.name, rec.Code, rec.Body.String())
+		}
+	}
+}
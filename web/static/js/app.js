@@ -47,6 +47,12 @@ document.body.addEventListener('htmx:sseMessage',e=>{
   }catch(_){}
 })
 
+// Ошибки htmx-запросов (4xx/5xx) — во всплывающее сообщение, иначе они не видны
+document.body.addEventListener('htmx:responseError',e=>{
+  const t=(e.detail.xhr.responseText||'').trim()
+  toast(t&&t.length<200?t:'Ошибка '+e.detail.xhr.status,'error')
+})
+
 // Toast
 function toast(msg,type='info',dur=3500){
   const c=document.getElementById('toast-container')